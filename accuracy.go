@@ -0,0 +1,248 @@
+package main
+
+import "strconv"
+import "strings"
+import "errors"
+import "sort"
+import "math"
+import "time"
+import "log"
+
+// accuracyHorizons are the minutes ahead of the arrival that the errors of the predictions are reported for.
+var accuracyHorizons = []int{1, 5, 10, 20}
+
+// accuracyMaxSamples bounds the errors kept per route and horizon, the oldest are dropped first.
+const accuracyMaxSamples = 5000
+
+// accuracyArrivalMinutes is how close a vehicle has to be predicted before its disappearance
+// from the predictions is taken as its arrival, rather than a vehicle taken out of service.
+const accuracyArrivalMinutes = 2
+
+type AccuracyRecorder struct {
+	NextBus
+	stops     []RecordedStop
+	interval  time.Duration
+	retention time.Duration
+}
+
+type RecordedStop struct {
+	Agency string
+	PredictedStop
+}
+
+// trackedArrival has the predicted arrival (epoch in milliseconds) observed at every poll (unix milliseconds).
+type trackedArrival struct {
+	DirTag    string
+	Vehicle   string
+	Block     string
+	Observed  []int64
+	Predicted []int64
+}
+
+type accuracySample struct {
+	At    int64
+	Error float64
+}
+
+// RouteAccuracy has the error of the predictions of a route per horizon, in seconds. Bias is the mean
+// error (positive when the vehicles arrive later than predicted), the percentiles are of the absolute error.
+type RouteAccuracy struct {
+	Route    string
+	Horizons []HorizonAccuracy
+}
+
+type HorizonAccuracy struct {
+	Minutes int
+	Samples int
+	Bias    float64
+	P50     float64
+	P75     float64
+	P90     float64
+	P95     float64
+}
+
+// ParseRecordedStops reads stops in the agency/route/stop form.
+func ParseRecordedStops(stops []string) ([]RecordedStop, error) {
+	recorded := []RecordedStop{}
+	for _, stop := range stops {
+		tags := strings.Split(stop, "/")
+		if len(tags) != 3 || tags[0] == "" || tags[1] == "" || tags[2] == "" {
+			return nil, errors.New("stops should be agency/route/stop: " + stop)
+		}
+		recorded = append(recorded, RecordedStop{tags[0], PredictedStop{tags[1], tags[2]}})
+	}
+	return recorded, nil
+}
+
+func NewAccuracyRecorder(nextBus NextBus, stops []RecordedStop, interval, retention time.Duration) AccuracyRecorder {
+	return AccuracyRecorder{nextBus, stops, interval, retention}
+}
+
+func accuracyKey(agencyTag, routeTag string, horizon int) string {
+	return "accuracy/" + agencyTag + "/" + routeTag + "/" + strconv.Itoa(horizon)
+}
+
+// Record snapshots the predictions of the stops every interval until the program exits.
+func (recorder AccuracyRecorder) Record() {
+	if len(recorder.stops) == 0 {
+		return
+	}
+	for range time.Tick(recorder.interval) {
+		if claimed, err := recorder.claim("accuracy/recorded", recorder.interval); err != nil || !claimed {
+			if err != nil {
+				log.Printf("Recording predictions failed: %v", err.Error())
+			}
+			continue
+		}
+		for _, stop := range recorder.stops {
+			if err := recorder.record(stop); err != nil {
+				log.Printf("Recording predictions of %v/%v/%v failed: %v", stop.Agency, stop.RouteTag, stop.StopTag, err.Error())
+			}
+		}
+	}
+}
+
+// record stores the errors of all the previous predictions of the vehicles that arrived at a stop.
+func (recorder AccuracyRecorder) record(stop RecordedStop) error {
+	predictions, err := recorder.PollPredictions(stop.Agency, stop.PredictedStop, recorder.interval)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	arrived, err := recorder.trackArrivals("accuracy/"+predictionsKey(stop.Agency, stop.PredictedStop), predictions, now)
+	if err != nil {
+		return err
+	}
+	samples := map[int][]accuracySample{}
+	for _, observations := range arrived {
+		// every arrival counts once per horizon, with the prediction made the closest to it
+		closest, distances := map[int]int{}, map[int]float64{}
+		for i := range observations.Observed {
+			horizon, distance, ok := accuracyHorizon(observations.Predicted[i] - observations.Observed[i])
+			if _, found := closest[horizon]; ok && (!found || distance < distances[horizon]) {
+				closest[horizon], distances[horizon] = i, distance
+			}
+		}
+		for horizon, i := range closest {
+			samples[horizon] = append(samples[horizon], accuracySample{now, float64(now-observations.Predicted[i]) / 1000})
+		}
+	}
+	for horizon, horizonSamples := range samples {
+		if err := recorder.store(stop.Agency, stop.RouteTag, horizon, horizonSamples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackArrivals compares the current predictions of a stop with the ones tracked so far under a key, and
+// returns the arrivals that happened now (unix milliseconds): the vehicles predicted to be there already,
+// or that were about to and are no longer predicted.
+func (nb NextBus) trackArrivals(trackingKey string, predictions *StopPredictions, now int64) (map[string]trackedArrival, error) {
+	tracked := map[string]trackedArrival{}
+	if _, _, err := nb.Get(trackingKey, &tracked); err != nil {
+		return nil, err
+	}
+	current := map[string]trackedArrival{}
+	arrived := map[string]trackedArrival{}
+	for _, prediction := range predictions.Predictions() {
+		arrival := prediction.TripTag
+		if arrival == "" {
+			arrival = prediction.Vehicle + "/" + prediction.Block
+		}
+		observations := tracked[arrival]
+		observations.DirTag, observations.Vehicle, observations.Block = prediction.DirTag, prediction.Vehicle, prediction.Block
+		observations.Observed = append(observations.Observed, now)
+		observations.Predicted = append(observations.Predicted, prediction.EpochTime)
+		if prediction.EpochTime <= now {
+			arrived[arrival] = observations
+		} else {
+			current[arrival] = observations
+		}
+	}
+	for arrival, observations := range tracked {
+		_, predicted := current[arrival]
+		_, done := arrived[arrival]
+		last := observations.Predicted[len(observations.Predicted)-1]
+		if !predicted && !done && last-now <= accuracyArrivalMinutes*60*1000 {
+			arrived[arrival] = observations
+		}
+	}
+	return arrived, nb.SetFor(trackingKey, current, time.Hour)
+}
+
+func (recorder AccuracyRecorder) store(agencyTag, routeTag string, horizon int, samples []accuracySample) error {
+	cacheValueKey := accuracyKey(agencyTag, routeTag, horizon)
+	lockId, err := recorder.Lock(cacheValueKey)
+	if err != nil {
+		return err
+	}
+	defer recorder.Unlock(cacheValueKey, lockId)
+	stored := []accuracySample{}
+	if _, _, err = recorder.Get(cacheValueKey, &stored); err != nil {
+		return err
+	}
+	oldest := time.Now().Add(-recorder.retention).UnixNano() / int64(time.Millisecond)
+	kept := []accuracySample{}
+	for _, sample := range append(stored, samples...) {
+		if sample.At >= oldest {
+			kept = append(kept, sample)
+		}
+	}
+	if len(kept) > accuracyMaxSamples {
+		kept = kept[len(kept)-accuracyMaxSamples:]
+	}
+	return recorder.SetFor(cacheValueKey, kept, recorder.retention)
+}
+
+// accuracyHorizon returns the closest horizon to how far ahead (in milliseconds) a prediction was made
+// and how far it is from it, if any is close enough.
+func accuracyHorizon(ahead int64) (int, float64, bool) {
+	minutes := float64(ahead) / 60000
+	closest, distance := 0, math.Inf(1)
+	for _, horizon := range accuracyHorizons {
+		// compared in log scale, a minute off matters more for the closer horizons
+		if d := math.Abs(math.Log(minutes / float64(horizon))); d < distance {
+			closest, distance = horizon, d
+		}
+	}
+	return closest, distance, minutes > 0 && distance <= math.Log(1.5)
+}
+
+// GetRouteAccuracy returns the error of the predictions recorded for the stops of a route.
+func (recorder AccuracyRecorder) GetRouteAccuracy(agencyTag, routeTag string) (*RouteAccuracy, error) {
+	accuracy := &RouteAccuracy{routeTag, []HorizonAccuracy{}}
+	oldest := time.Now().Add(-recorder.retention).UnixNano() / int64(time.Millisecond)
+	for _, horizon := range accuracyHorizons {
+		samples := []accuracySample{}
+		if _, _, err := recorder.Get(accuracyKey(agencyTag, routeTag, horizon), &samples); err != nil {
+			return nil, err
+		}
+		absolute := []float64{}
+		bias := 0.0
+		for _, sample := range samples {
+			if sample.At >= oldest {
+				absolute = append(absolute, math.Abs(sample.Error))
+				bias += sample.Error
+			}
+		}
+		result := HorizonAccuracy{Minutes: horizon, Samples: len(absolute)}
+		if len(absolute) > 0 {
+			sort.Float64s(absolute)
+			result.Bias = bias / float64(len(absolute))
+			result.P50, result.P75 = percentile(absolute, 50), percentile(absolute, 75)
+			result.P90, result.P95 = percentile(absolute, 90), percentile(absolute, 95)
+		}
+		accuracy.Horizons = append(accuracy.Horizons, result)
+	}
+	return accuracy, nil
+}
+
+// percentile of sorted values, by the nearest rank.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+import "time"
+
+func TestAccuracyHorizon(t *testing.T) {
+	cases := []struct {
+		ahead   time.Duration
+		horizon int
+		ok      bool
+	}{
+		{time.Minute, 1, true},
+		{80 * time.Second, 1, true},
+		{4 * time.Minute, 5, true},
+		{7 * time.Minute, 5, true},
+		{25 * time.Minute, 20, true},
+		{45 * time.Minute, 20, false},
+		{2*time.Minute + 30*time.Second, 0, false},
+		{-time.Minute, 0, false},
+	}
+	for _, c := range cases {
+		horizon, _, ok := accuracyHorizon(int64(c.ahead / time.Millisecond))
+		if ok != c.ok || ok && horizon != c.horizon {
+			t.Errorf("predictions made %v ahead: expected horizon %v (%v), got %v (%v)", c.ahead, c.horizon, c.ok, horizon, ok)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for p, expected := range map[float64]float64{0: 1, 50: 5, 75: 8, 90: 9, 95: 10, 100: 10} {
+		if value := percentile(sorted, p); value != expected {
+			t.Errorf("percentile %v: expected %v, got %v", p, expected, value)
+		}
+	}
+}
+
+func newTestRecorder() AccuracyRecorder {
+	return NewAccuracyRecorder(newTestNextBus(NewMemoryUpstream()), nil, 30*time.Second, time.Hour)
+}
+
+func TestTrackArrivals(t *testing.T) {
+	recorder := newTestRecorder()
+	now := int64(1000000000000)
+	first := (&StopPredictions{Direction: []PredictionsDirection{{Prediction: []Prediction{
+		{EpochTime: now + 60000, TripTag: "t1"},
+		{EpochTime: now + 30*60000, TripTag: "t2"},
+		{EpochTime: now + 10*60000, Vehicle: "v3", Block: "b3"},
+	}}}}).normalize()
+	if arrived, err := recorder.trackArrivals("tracking", first, now); err != nil || len(arrived) != 0 {
+		t.Fatalf("expected no arrivals yet, got %+v %v", arrived, err)
+	}
+	// t1 was about to arrive and is gone, v3 is predicted to be there already and t2 was taken out of service
+	now += 90000
+	second := (&StopPredictions{Direction: []PredictionsDirection{{Prediction: []Prediction{
+		{EpochTime: now - 1000, Vehicle: "v3", Block: "b3"},
+	}}}}).normalize()
+	arrived, err := recorder.trackArrivals("tracking", second, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arrived) != 2 || len(arrived["t1"].Predicted) != 1 || len(arrived["v3/b3"].Predicted) != 2 {
+		t.Errorf("expected the arrivals of t1 and v3 with all their observations, got %+v", arrived)
+	}
+	if arrived, _ = recorder.trackArrivals("tracking", second, now+30000); len(arrived) != 1 {
+		t.Errorf("the arrived vehicles shouldn't be tracked anymore, got %+v", arrived)
+	}
+}
+
+func TestRouteAccuracy(t *testing.T) {
+	recorder := newTestRecorder()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	old := time.Now().Add(-2*time.Hour).UnixNano() / int64(time.Millisecond)
+	samples := []accuracySample{{now, 30}, {now, -60}, {now, 90}, {now, 120}, {old, 1000}}
+	if err := recorder.store("sf-muni", "N", 5, samples); err != nil {
+		t.Fatal(err)
+	}
+	accuracy, err := recorder.GetRouteAccuracy("sf-muni", "N")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accuracy.Horizons) != len(accuracyHorizons) {
+		t.Fatalf("expected every horizon, got %+v", accuracy.Horizons)
+	}
+	for _, horizon := range accuracy.Horizons {
+		if horizon.Minutes != 5 {
+			if horizon.Samples != 0 {
+				t.Errorf("expected no samples for horizon %v, got %+v", horizon.Minutes, horizon)
+			}
+			continue
+		}
+		expected := HorizonAccuracy{Minutes: 5, Samples: 4, Bias: 45, P50: 60, P75: 90, P90: 120, P95: 120}
+		if horizon != expected {
+			t.Errorf("expected %+v leaving out the samples past the retention, got %+v", expected, horizon)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import "compress/gzip"
+import "encoding/json"
+import "path/filepath"
+import "io/ioutil"
+import "strings"
+import "sort"
+import "time"
+import "log"
+import "io"
+import "os"
+
+// Archive keeps the snapshots of the vehicle locations of some agencies in local segment files, one per
+// agency and day in the agency timezone, i.e. archive/sf-muni/2026-10-16.jsonl.gz. Every snapshot is
+// appended as a separate gzip member holding a JSON line, so a segment is never rewritten and a crash
+// at most loses the snapshot being written.
+type Archive struct {
+	NextBus
+	dir       string
+	agencies  []string
+	interval  time.Duration
+	retention time.Duration
+}
+
+type ArchivedSnapshot struct {
+	Time     time.Time
+	Vehicles []Vehicle
+}
+
+// VehicleTrail has the positions a vehicle reported while serving a route, oldest first.
+type VehicleTrail struct {
+	Id        string
+	RouteTag  string
+	Positions []TrailPosition
+}
+
+type TrailPosition struct {
+	Time      time.Time
+	DirTag    string
+	Lat       float64
+	Lon       float64
+	Heading   int
+	SpeedKmHr float64
+}
+
+func NewArchive(nextBus NextBus, dir string, agencies []string, interval, retention time.Duration) Archive {
+	return Archive{nextBus, dir, agencies, interval, retention}
+}
+
+func (archive Archive) segmentPath(agencyTag string, date time.Time) string {
+	return filepath.Join(archive.dir, agencyTag, date.Format("2006-01-02")+".jsonl.gz")
+}
+
+// Run archives the vehicle locations of the agencies every interval until the program exits. Every
+// instance archives into its own files, so they can be queried from any of them.
+func (archive Archive) Run() {
+	if len(archive.agencies) == 0 {
+		return
+	}
+	for range time.Tick(archive.interval) {
+		for _, agencyTag := range archive.agencies {
+			vehicles, err := archive.GetVehicleLocations(agencyTag, "", 0)
+			if err != nil {
+				log.Printf("Archiving vehicles of agency <%v> failed: %v", agencyTag, err.Error())
+				continue
+			}
+			now := time.Now().In(archive.timezones.Location(agencyTag))
+			if err = archive.append(agencyTag, ArchivedSnapshot{now, vehicles.Vehicle}); err != nil {
+				log.Printf("Archiving vehicles of agency <%v> failed: %v", agencyTag, err.Error())
+			}
+		}
+	}
+}
+
+// append writes a snapshot at the end of the segment of its day, the segments past the retention
+// are removed whenever a new one is started, including those of the agencies no longer archived.
+func (archive Archive) append(agencyTag string, snapshot ArchivedSnapshot) error {
+	path := archive.segmentPath(agencyTag, serviceDate(snapshot.Time))
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		archive.prune(snapshot.Time)
+	}
+	line, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := gzip.NewWriter(file)
+	if _, err = writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// prune removes the segments of every agency directory under dir older than the retention.
+func (archive Archive) prune(now time.Time) {
+	agencies, err := ioutil.ReadDir(archive.dir)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	oldest := serviceDate(now.Add(-archive.retention))
+	for _, agency := range agencies {
+		if !agency.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(archive.dir, agency.Name()))
+		if err != nil {
+			log.Print(err.Error())
+			continue
+		}
+		for _, file := range files {
+			date, err := time.ParseInLocation("2006-01-02", strings.TrimSuffix(file.Name(), ".jsonl.gz"), now.Location())
+			if err == nil && date.Before(oldest) {
+				if err = os.Remove(filepath.Join(archive.dir, agency.Name(), file.Name())); err != nil {
+					log.Print(err.Error())
+				}
+			}
+		}
+	}
+}
+
+// ReadSegment visits the snapshots of an agency archived during a day in order, until visit returns false.
+// Days without a segment have no snapshots. The segment of today may be read while it's being written,
+// a snapshot cut short at its end is left out.
+func (archive Archive) ReadSegment(agencyTag string, date time.Time, visit func(ArchivedSnapshot) bool) error {
+	file, err := os.Open(archive.segmentPath(agencyTag, date))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	decoder := json.NewDecoder(reader)
+	for {
+		snapshot := ArchivedSnapshot{}
+		err := decoder.Decode(&snapshot)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !visit(snapshot) {
+			return nil
+		}
+	}
+}
+
+// GetTrails returns the positions reported between two times by the vehicles of an agency, of a route,
+// of a vehicle, or both. A position is only listed once no matter how many snapshots it appears in.
+func (archive Archive) GetTrails(agencyTag, routeTag, vehicleId string, from, to time.Time) ([]VehicleTrail, error) {
+	trails := map[[2]string]*VehicleTrail{}
+	for date := serviceDate(from); !date.After(to); date = date.AddDate(0, 0, 1) {
+		err := archive.ReadSegment(agencyTag, date, func(snapshot ArchivedSnapshot) bool {
+			for _, vehicle := range snapshot.Vehicles {
+				if (routeTag != "" && vehicle.RouteTag != routeTag) || (vehicleId != "" && vehicle.Id != vehicleId) {
+					continue
+				}
+				reported := snapshot.Time.Add(-time.Duration(vehicle.SecsSinceReport) * time.Second).Truncate(time.Second)
+				if reported.Before(from) || reported.After(to) {
+					continue
+				}
+				key := [2]string{vehicle.Id, vehicle.RouteTag}
+				trail, ok := trails[key]
+				if !ok {
+					trail = &VehicleTrail{vehicle.Id, vehicle.RouteTag, []TrailPosition{}}
+					trails[key] = trail
+				}
+				if last := len(trail.Positions) - 1; last >= 0 && !reported.After(trail.Positions[last].Time) {
+					continue
+				}
+				trail.Positions = append(trail.Positions, TrailPosition{reported, vehicle.DirTag, vehicle.Lat, vehicle.Lon,
+					vehicle.Heading, vehicle.SpeedKmHr})
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	result := []VehicleTrail{}
+	for _, trail := range trails {
+		result = append(result, *trail)
+	}
+	sort.Sort(byVehicleAndRoute(result))
+	return result, nil
+}
+
+type byVehicleAndRoute []VehicleTrail
+
+func (trails byVehicleAndRoute) Len() int      { return len(trails) }
+func (trails byVehicleAndRoute) Swap(i, j int) { trails[i], trails[j] = trails[j], trails[i] }
+func (trails byVehicleAndRoute) Less(i, j int) bool {
+	if trails[i].Id != trails[j].Id {
+		return trails[i].Id < trails[j].Id
+	}
+	return trails[i].RouteTag < trails[j].RouteTag
+}
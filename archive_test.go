@@ -0,0 +1,139 @@
+package main
+
+import "compress/gzip"
+import "path/filepath"
+import "io/ioutil"
+import "testing"
+import "bytes"
+import "time"
+import "os"
+
+func newTestArchive(t *testing.T) Archive {
+	return NewArchive(newTestNextBus(NewMemoryUpstream()), t.TempDir(), []string{"sf-muni"}, time.Minute, 48*time.Hour)
+}
+
+func readSnapshots(t *testing.T, archive Archive, date time.Time) []ArchivedSnapshot {
+	snapshots := []ArchivedSnapshot{}
+	err := archive.ReadSegment("sf-muni", date, func(snapshot ArchivedSnapshot) bool {
+		snapshots = append(snapshots, snapshot)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshots
+}
+
+func TestArchiveReadsTheAppendedSnapshots(t *testing.T) {
+	archive := newTestArchive(t)
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		snapshot := ArchivedSnapshot{start.Add(time.Duration(i) * time.Minute), []Vehicle{{Id: "1", RouteTag: "N", Heading: i}}}
+		if err := archive.append("sf-muni", snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshots := readSnapshots(t, archive, serviceDate(start))
+	if len(snapshots) != 3 {
+		t.Fatalf("expected the 3 snapshots appended, got %+v", snapshots)
+	}
+	for i, snapshot := range snapshots {
+		if !snapshot.Time.Equal(start.Add(time.Duration(i)*time.Minute)) || snapshot.Vehicles[0].Heading != i {
+			t.Errorf("expected the snapshots in order, got %+v at %v", snapshot, i)
+		}
+	}
+	if snapshots := readSnapshots(t, archive, serviceDate(start).AddDate(0, 0, 1)); len(snapshots) != 0 {
+		t.Errorf("expected no snapshots on a day without a segment, got %+v", snapshots)
+	}
+}
+
+func TestArchiveSkipsASnapshotCutShort(t *testing.T) {
+	archive := newTestArchive(t)
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	if err := archive.append("sf-muni", ArchivedSnapshot{start, []Vehicle{{Id: "1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	// a member being written when the segment is read
+	member := bytes.Buffer{}
+	writer := gzip.NewWriter(&member)
+	writer.Write([]byte(`{"Time":"2026-10-14T12:01:00Z","Vehicles":[{"Id":"2"}]}` + "\n"))
+	writer.Close()
+	file, err := os.OpenFile(archive.segmentPath("sf-muni", serviceDate(start)), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(member.Bytes()[:member.Len()/2])
+	file.Close()
+	snapshots := readSnapshots(t, archive, serviceDate(start))
+	if len(snapshots) != 1 || snapshots[0].Vehicles[0].Id != "1" {
+		t.Errorf("expected the complete snapshot only, got %+v", snapshots)
+	}
+}
+
+func TestTrailsAcrossDays(t *testing.T) {
+	archive := newTestArchive(t)
+	midnight := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+	for _, snapshot := range []ArchivedSnapshot{
+		{midnight.Add(-time.Minute), []Vehicle{
+			{Id: "2", RouteTag: "N", Lat: 1, SecsSinceReport: 10},
+			{Id: "1", RouteTag: "N", Lat: 1, SecsSinceReport: 5},
+		}},
+		// the vehicle 1 didn't report again since the snapshot before
+		{midnight.Add(-time.Minute + 30*time.Second), []Vehicle{
+			{Id: "1", RouteTag: "N", Lat: 1, SecsSinceReport: 35},
+			{Id: "1", RouteTag: "38", Lat: 5, SecsSinceReport: 0},
+		}},
+		{midnight.Add(time.Minute), []Vehicle{
+			{Id: "1", RouteTag: "N", Lat: 2, SecsSinceReport: 0},
+			{Id: "2", RouteTag: "N", Lat: 2, SecsSinceReport: 0},
+		}},
+	} {
+		if err := archive.append("sf-muni", snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trails, err := archive.GetTrails("sf-muni", "N", "", midnight.Add(-time.Hour), midnight.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trails) != 2 || trails[0].Id != "1" || trails[1].Id != "2" {
+		t.Fatalf("expected the trails of the vehicles 1 and 2 of the route, got %+v", trails)
+	}
+	for _, trail := range trails {
+		if len(trail.Positions) != 2 || trail.Positions[0].Lat != 1 || trail.Positions[1].Lat != 2 ||
+			!trail.Positions[1].Time.Equal(midnight.Add(time.Minute)) {
+			t.Errorf("expected a position on each day, got %+v", trail)
+		}
+	}
+	if trails, _ := archive.GetTrails("sf-muni", "", "1", midnight.Add(-time.Hour), midnight); len(trails) != 2 || trails[0].RouteTag != "38" {
+		t.Errorf("expected the trails of the vehicle on every route until midnight, got %+v", trails)
+	}
+}
+
+func TestArchivePrunesPastTheRetention(t *testing.T) {
+	archive := newTestArchive(t)
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	old := []string{archive.segmentPath("sf-muni", now.AddDate(0, 0, -3)), archive.segmentPath("ac-transit", now.AddDate(0, 0, -3))}
+	kept := []string{archive.segmentPath("sf-muni", now.AddDate(0, 0, -2)), archive.segmentPath("ac-transit", now.AddDate(0, 0, -1))}
+	for _, path := range append(old, kept...) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.append("sf-muni", ArchivedSnapshot{now, []Vehicle{}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range old {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %v to be removed", path)
+		}
+	}
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %v to be kept: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "strconv"
+import "time"
+import "log"
+
+type RoutesAvailability struct {
+	Time       time.Time
+	Running    []RouteAvailability
+	NotRunning []RouteAvailability
+	Unknown    []RouteAvailability
+}
+
+// RouteAvailability has the next departure of the route when none of its directions is running,
+// within the service date and the next one.
+type RouteAvailability struct {
+	nextbus.Route
+	Directions    []DirectionAvailability
+	NextDeparture *time.Time
+}
+
+// DirectionAvailability has the first and last departures of a direction for the service date,
+// or for the previous one when the direction is still running trips that started before midnight.
+type DirectionAvailability struct {
+	Direction      string
+	ServiceClass   string
+	FirstDeparture time.Time
+	LastDeparture  time.Time
+	Running        bool
+}
+
+// tripSpan is the earliest and latest epoch times of a trip.
+type tripSpan struct {
+	start int
+	end   int
+}
+
+// tripSpans returns the span of every trip of a schedule, skipping the stops that are not served.
+func tripSpans(schedule nextbus.Schedule) ([]tripSpan, error) {
+	spans := []tripSpan{}
+	for _, tr := range schedule.Tr {
+		span := tripSpan{1<<63 - 1, -1 << 63} //max and min ints
+		for _, stop := range tr.Stop {
+			if stop.Content != "--" {
+				epoch, err := strconv.Atoi(stop.EpochTime)
+				if err != nil {
+					return nil, err
+				}
+				if span.start > epoch {
+					span.start = epoch
+				}
+				if epoch > span.end {
+					span.end = epoch
+				}
+			}
+		}
+		if span.start <= span.end {
+			spans = append(spans, span)
+		}
+	}
+	return spans, nil
+}
+
+// GetRouteAvailability tells which directions of a route are running at a time in the agency timezone.
+// A direction is running when the time falls within one of its trips, give or take the tolerance,
+// so gaps between trips (i.e. peak only routes) are not running. Returns nil when the service classes
+// of the route are unknown.
+func (nb NextBus) GetRouteAvailability(agencyTag string, route nextbus.Route, at time.Time) (*RouteAvailability, error) {
+	schedules, err := nb.GetSchedules(agencyTag, route.Tag)
+	if err != nil {
+		return nil, err
+	}
+	if !knownServiceClasses(schedules) {
+		return nil, nil
+	}
+	date := serviceDate(at)
+	availability := &RouteAvailability{route, []DirectionAvailability{}, nil}
+	directions := map[string]int{}
+	// trips that go past midnight belong to the service date before, with epoch times over 24 hours.
+	// The service date after is only looked at for the next departure.
+	for _, day := range []time.Time{date, date.AddDate(0, 0, -1), date.AddDate(0, 0, 1)} {
+		for _, schedule := range serviceSchedules(schedules, day) {
+			spans, err := tripSpans(schedule)
+			if err != nil {
+				return nil, err
+			}
+			if len(spans) == 0 {
+				continue
+			}
+			direction := DirectionAvailability{schedule.Direction, schedule.ServiceClass,
+				scheduleTime(day, spans[0].start), scheduleTime(day, spans[0].end), false}
+			for _, span := range spans {
+				start, end := scheduleTime(day, span.start), scheduleTime(day, span.end)
+				if start.Before(direction.FirstDeparture) {
+					direction.FirstDeparture = start
+				}
+				if end.After(direction.LastDeparture) {
+					direction.LastDeparture = end
+				}
+				if !at.Before(start.Add(-nb.tolerance)) && !at.After(end.Add(nb.tolerance)) {
+					direction.Running = true
+				}
+				if start.After(at) && (availability.NextDeparture == nil || start.Before(*availability.NextDeparture)) {
+					availability.NextDeparture = &start
+				}
+			}
+			i, found := directions[direction.Direction]
+			switch {
+			case !found && (day.Equal(date) || direction.Running):
+				directions[direction.Direction] = len(availability.Directions)
+				availability.Directions = append(availability.Directions, direction)
+			case found && day.Equal(date):
+				merged := &availability.Directions[i]
+				if direction.FirstDeparture.Before(merged.FirstDeparture) {
+					merged.FirstDeparture = direction.FirstDeparture
+				}
+				if direction.LastDeparture.After(merged.LastDeparture) {
+					merged.LastDeparture = direction.LastDeparture
+				}
+				merged.Running = merged.Running || direction.Running
+			case found:
+				availability.Directions[i].Running = availability.Directions[i].Running || direction.Running
+			}
+		}
+	}
+	if availability.running() {
+		availability.NextDeparture = nil
+	}
+	return availability, nil
+}
+
+// GetRoutesAvailability splits the routes of an agency in the ones running at a time, the ones
+// that are not and the ones which schedules are unavailable or have unknown service classes.
+func (nb NextBus) GetRoutesAvailability(agencyTag string, at time.Time) (*RoutesAvailability, error) {
+	routes, err := nb.GetRoutes(agencyTag)
+	if err != nil {
+		return nil, err
+	}
+	running := []RouteAvailability{}
+	notRunning := []RouteAvailability{}
+	unavailableData := []RouteAvailability{}
+	for _, route := range routes {
+		availability, err := nb.GetRouteAvailability(agencyTag, route, at)
+		if err != nil || availability == nil {
+			log.Printf("Schedules for route <%v> either failed or returned an unknown service", route.Tag)
+			unavailableData = append(unavailableData, RouteAvailability{route, []DirectionAvailability{}, nil})
+			continue
+		}
+		if availability.running() {
+			running = append(running, *availability)
+		} else {
+			notRunning = append(notRunning, *availability)
+		}
+	}
+	return &RoutesAvailability{at, running, notRunning, unavailableData}, nil
+}
+
+func (availability RouteAvailability) running() bool {
+	for _, direction := range availability.Directions {
+		if direction.Running {
+			return true
+		}
+	}
+	return false
+}
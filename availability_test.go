@@ -0,0 +1,95 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "strconv"
+import "testing"
+import "time"
+
+// trip builds a schedule trip from the epoch times of its stops, -1 being a stop that isn't served.
+func trip(block string, epochs ...int) nextbus.Tr {
+	tr := nextbus.Tr{BlockID: block}
+	for i, epoch := range epochs {
+		stop := nextbus.ScheduleStop{Tag: strconv.Itoa(i), EpochTime: "-1", Content: "--"}
+		if epoch >= 0 {
+			stop.EpochTime, stop.Content = strconv.Itoa(epoch), "x"
+		}
+		tr.Stop = append(tr.Stop, stop)
+	}
+	return tr
+}
+
+func hours(h float64) int {
+	return int(h * float64(time.Hour/time.Millisecond))
+}
+
+func newAvailabilityNextBus(serviceClass string) NextBus {
+	memory := NewMemoryUpstream()
+	memory.Schedules["sf-muni/N"] = []nextbus.Schedule{{
+		ServiceClass: serviceClass,
+		Direction:    "Inbound",
+		Tr: []nextbus.Tr{
+			trip("1", hours(7), -1, hours(8)),
+			trip("2", hours(17), hours(17.5), hours(18)),
+			trip("3", hours(24.5), -1, hours(25)),
+		},
+	}}
+	return newTestNextBus(memory)
+}
+
+func TestTripSpans(t *testing.T) {
+	spans, err := tripSpans(nextbus.Schedule{Tr: []nextbus.Tr{trip("1", -1, hours(9), hours(8)), trip("2", -1, -1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 1 || spans[0].start != hours(8) || spans[0].end != hours(9) {
+		t.Errorf("expected a single span from 8 to 9 skipping the trips that serve no stop, got %+v", spans)
+	}
+}
+
+func TestRouteAvailability(t *testing.T) {
+	nb := newAvailabilityNextBus("wkd")
+	route := nextbus.Route{Tag: "N"}
+	wednesday := time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name    string
+		at      time.Time
+		running bool
+		next    *time.Time
+	}{
+		{"during a trip", wednesday.Add(7*time.Hour + 30*time.Minute), true, nil},
+		{"within the tolerance", wednesday.Add(8*time.Hour + 4*time.Minute), true, nil},
+		{"between trips", wednesday.Add(12 * time.Hour), false, timePtr(wednesday.Add(17 * time.Hour))},
+		{"past midnight on the trips of the day before", wednesday.Add(24*time.Hour + 40*time.Minute), true, nil},
+		{"on a day without service", wednesday.Add(4 * 24 * time.Hour), false, timePtr(wednesday.Add(5*24*time.Hour + 7*time.Hour))},
+	}
+	for _, c := range cases {
+		availability, err := nb.GetRouteAvailability("sf-muni", route, c.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if availability == nil {
+			t.Fatalf("%v: the service class should be known", c.name)
+		}
+		if availability.running() != c.running {
+			t.Errorf("%v: expected running %v, got %+v", c.name, c.running, availability)
+		}
+		if (c.next == nil) != (availability.NextDeparture == nil) || c.next != nil && !c.next.Equal(*availability.NextDeparture) {
+			t.Errorf("%v: expected the next departure at %v, got %v", c.name, c.next, availability.NextDeparture)
+		}
+	}
+}
+
+func TestRouteAvailabilityUnknownServiceClass(t *testing.T) {
+	nb := newAvailabilityNextBus("holiday")
+	availability, err := nb.GetRouteAvailability("sf-muni", nextbus.Route{Tag: "N"}, time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if availability != nil {
+		t.Errorf("routes with unknown service classes should have no availability, got %+v", availability)
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
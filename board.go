@@ -0,0 +1,150 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "math"
+import "sort"
+import "time"
+import "log"
+
+// boardMatchWindow is how far from a prediction the scheduled departure of the same block can be
+// to take it as the one the vehicle is running.
+const boardMatchWindow = 30 * time.Minute
+
+type DepartureBoard struct {
+	StopTag    string
+	StopTitle  string
+	Departures []BoardDeparture
+}
+
+// BoardDeparture is a predicted (Realtime) or scheduled departure from a stop. ScheduledTime and
+// Delay (in minutes, negative when early) are set for predictions that match a scheduled departure.
+type BoardDeparture struct {
+	RouteTag      string
+	RouteTitle    string
+	Direction     string
+	Time          time.Time
+	Realtime      bool
+	ScheduledTime *time.Time
+	Delay         *int
+	Vehicle       string
+}
+
+// GetDepartureBoard merges the predictions of all the routes that serve a stop with their scheduled
+// departures, which fill in for the routes without predictions and for the times past the last prediction.
+func (nb NextBus) GetDepartureBoard(agencyTag, stopTag string, limit int) (*DepartureBoard, error) {
+	index, err := nb.GetStopIndex(agencyTag)
+	if err != nil {
+		return nil, err
+	}
+	stop := index.Stop(stopTag)
+	if stop == nil {
+		return nil, nil
+	}
+	routes, err := nb.GetRoutes(agencyTag)
+	if err != nil {
+		return nil, err
+	}
+	titles := map[string]string{}
+	for _, route := range routes {
+		titles[route.Tag] = route.Title
+	}
+	now := time.Now().In(nb.timezones.Location(agencyTag))
+	board := &DepartureBoard{stop.Tag, stop.Title, []BoardDeparture{}}
+	for _, routeTag := range stop.Routes {
+		predictions, err := nb.GetPredictions(agencyTag, routeTag, stopTag)
+		if err != nil {
+			log.Printf("Departure board of stop <%v> without predictions for route <%v>: %v", stopTag, routeTag, err.Error())
+			predictions = (&StopPredictions{}).normalize()
+		}
+		scheduled, err := nb.GetScheduledDepartures(agencyTag, routeTag, stopTag, "", now.Add(-boardMatchWindow), math.MaxInt32)
+		if err != nil {
+			log.Printf("Departure board of stop <%v> without schedules for route <%v>: %v", stopTag, routeTag, err.Error())
+			scheduled = []ScheduledDeparture{}
+		}
+		// the departures gone already are only there to be matched with the predictions, they don't count for the limit
+		upcoming := 0
+		for i, departure := range scheduled {
+			if !departure.Time.Before(now) {
+				if upcoming++; upcoming > limit+len(predictions.Predictions()) {
+					scheduled = scheduled[:i]
+					break
+				}
+			}
+		}
+		directions, err := nb.GetDirections(agencyTag, routeTag)
+		if err != nil {
+			log.Printf("Departure board of stop <%v> without directions for route <%v>: %v", stopTag, routeTag, err.Error())
+		}
+		names := map[string]string{}
+		for _, direction := range directions {
+			names[direction.Tag] = direction.Name
+		}
+		route := nextbus.Route{Tag: routeTag, Title: titles[routeTag]}
+		board.Departures = append(board.Departures, mergeDepartures(route, predictions, scheduled, names, now)...)
+	}
+	sort.Sort(byBoardTime(board.Departures))
+	if len(board.Departures) > limit {
+		board.Departures = board.Departures[:limit]
+	}
+	return board, nil
+}
+
+// mergeDepartures matches every prediction with the closest scheduled departure of its block to tell
+// the delay. Scheduled departures after the last prediction of their direction are added as they are,
+// not the ones before since those vehicles would already be predicted. The directions of the predictions
+// are named after their tags (as in the schedules) with names, or else by their title.
+func mergeDepartures(route nextbus.Route, predictions *StopPredictions, scheduled []ScheduledDeparture, names map[string]string, now time.Time) []BoardDeparture {
+	departures := []BoardDeparture{}
+	matched := map[int]bool{}
+	last := map[string]time.Time{}
+	for _, direction := range predictions.Direction {
+		for _, prediction := range direction.Prediction {
+			name, ok := names[prediction.DirTag]
+			if !ok {
+				name = direction.Title
+			}
+			predicted := time.Unix(0, prediction.EpochTime*int64(time.Millisecond)).In(now.Location())
+			departure := BoardDeparture{route.Tag, route.Title, direction.Title, predicted, true, nil, nil, prediction.Vehicle}
+			closest := -1
+			for i, schedule := range scheduled {
+				if matched[i] || prediction.Block == "" || schedule.BlockID != prediction.Block {
+					continue
+				}
+				if gap := absDuration(predicted.Sub(schedule.Time)); gap <= boardMatchWindow &&
+					(closest < 0 || gap < absDuration(predicted.Sub(scheduled[closest].Time))) {
+					closest = i
+				}
+			}
+			if closest >= 0 {
+				matched[closest] = true
+				delay := int(math.Floor(predicted.Sub(scheduled[closest].Time).Minutes() + 0.5))
+				departure.ScheduledTime, departure.Delay = &scheduled[closest].Time, &delay
+			}
+			if predicted.After(last[name]) {
+				last[name] = predicted
+			}
+			departures = append(departures, departure)
+		}
+	}
+	for i, schedule := range scheduled {
+		if !matched[i] && !schedule.Time.Before(now) && schedule.Time.After(last[schedule.Direction]) {
+			departures = append(departures, BoardDeparture{route.Tag, route.Title, schedule.Direction, schedule.Time, false, nil, nil, ""})
+		}
+	}
+	return departures
+}
+
+func absDuration(duration time.Duration) time.Duration {
+	if duration < 0 {
+		return -duration
+	}
+	return duration
+}
+
+type byBoardTime []BoardDeparture
+
+func (departures byBoardTime) Len() int      { return len(departures) }
+func (departures byBoardTime) Swap(i, j int) { departures[i], departures[j] = departures[j], departures[i] }
+func (departures byBoardTime) Less(i, j int) bool {
+	return departures[i].Time.Before(departures[j].Time)
+}
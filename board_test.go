@@ -0,0 +1,100 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "strconv"
+import "testing"
+import "time"
+
+func TestMergeDepartures(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	date := serviceDate(now)
+	millis := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+	predictions := (&StopPredictions{Direction: []PredictionsDirection{{Title: "Inbound", Prediction: []Prediction{
+		{EpochTime: millis(now.Add(5 * time.Minute)), Block: "b1", Vehicle: "v1"},
+		{EpochTime: millis(now.Add(20 * time.Minute)), Block: "b2", Vehicle: "v2"},
+	}}}}).normalize()
+	scheduled := []ScheduledDeparture{
+		{now.Add(-10 * time.Minute), "Inbound", "wkd", "b0", date},
+		{now.Add(2 * time.Minute), "Inbound", "wkd", "b1", date},
+		{now.Add(15 * time.Minute), "Inbound", "wkd", "b3", date},
+		{now.Add(90 * time.Minute), "Inbound", "wkd", "b2", date},
+		{now.Add(40 * time.Minute), "Inbound", "wkd", "b4", date},
+	}
+	departures := mergeDepartures(nextbus.Route{Tag: "N", Title: "N-Judah"}, predictions, scheduled, nil, now)
+	if len(departures) != 4 {
+		t.Fatalf("expected the 2 predictions and the 2 scheduled departures after them, got %+v", departures)
+	}
+	first := departures[0]
+	if !first.Realtime || first.RouteTitle != "N-Judah" || first.Vehicle != "v1" {
+		t.Errorf("unexpected first departure %+v", first)
+	}
+	if first.ScheduledTime == nil || !first.ScheduledTime.Equal(scheduled[1].Time) || first.Delay == nil || *first.Delay != 3 {
+		t.Errorf("the prediction should match the schedule of its block with a delay of 3 minutes, got %+v", first)
+	}
+	if second := departures[1]; second.ScheduledTime != nil || second.Delay != nil {
+		t.Errorf("the schedules of the block further than the match window shouldn't match, got %+v", second)
+	}
+	for i, expected := range []time.Time{scheduled[3].Time, scheduled[4].Time} {
+		if departure := departures[2+i]; departure.Realtime || !departure.Time.Equal(expected) {
+			t.Errorf("expected a scheduled departure at %v, got %+v", expected, departure)
+		}
+	}
+}
+
+func TestMergeDeparturesCutsOffEveryDirectionAtItsOwnPredictions(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	date := serviceDate(now)
+	predictions := (&StopPredictions{Direction: []PredictionsDirection{{Title: "Inbound to Caltrain", Prediction: []Prediction{
+		{EpochTime: now.Add(20*time.Minute).UnixNano() / int64(time.Millisecond), DirTag: "N_I", Vehicle: "v1"},
+	}}}}).normalize()
+	scheduled := []ScheduledDeparture{
+		{now.Add(10 * time.Minute), "Inbound", "wkd", "b1", date},
+		{now.Add(10 * time.Minute), "Outbound", "wkd", "b2", date},
+		{now.Add(30 * time.Minute), "Inbound", "wkd", "b3", date},
+	}
+	departures := mergeDepartures(nextbus.Route{Tag: "N"}, predictions, scheduled, map[string]string{"N_I": "Inbound"}, now)
+	times := []string{}
+	for _, departure := range departures {
+		times = append(times, departure.Direction+"@"+departure.Time.Format("15:04"))
+	}
+	expected := []string{"Inbound to Caltrain@12:20", "Outbound@12:10", "Inbound@12:30"}
+	if len(times) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, times)
+	}
+	for i := range expected {
+		if times[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, times)
+			break
+		}
+	}
+}
+
+func TestDepartureBoardLimitLeavesOutTheDeparturesGone(t *testing.T) {
+	memory := NewMemoryUpstream()
+	memory.Routes["sf-muni"] = []nextbus.Route{{Tag: "N", Title: "N-Judah"}}
+	memory.RouteConfigs["sf-muni/N"] = nextbus.RouteConfig{
+		Tag:       "N",
+		Stop:      []nextbus.Stop{{Tag: "S", Title: "Judah St", Lat: "37.76", Lon: "-122.5"}, {Tag: "E", Title: "End", Lat: "37.77", Lon: "-122.4"}},
+		Direction: []nextbus.Direction{{Tag: "N_I", Name: "Inbound", Stop: []nextbus.DirectionStop{{Tag: "S"}, {Tag: "E"}}}},
+	}
+	now := time.Now().UTC()
+	tr := nextbus.Tr{}
+	for i, minutes := range []int{-20, -10, 10, 20, 30} {
+		epoch := int(now.Add(time.Duration(minutes)*time.Minute).Sub(serviceDate(now)) / time.Millisecond)
+		tr.Stop = append(tr.Stop, nextbus.ScheduleStop{Tag: "S", EpochTime: strconv.Itoa(epoch), Content: "x"})
+		memory.Schedules["sf-muni/N"] = append(memory.Schedules["sf-muni/N"], nextbus.Schedule{ServiceClass: "daily", Direction: "Inbound",
+			Tr: []nextbus.Tr{{BlockID: strconv.Itoa(i), Stop: tr.Stop[i:]}}})
+	}
+	board, err := newTestNextBus(memory).GetDepartureBoard("sf-muni", "S", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(board.Departures) != 2 {
+		t.Fatalf("expected the next 2 scheduled departures, got %+v", board.Departures)
+	}
+	for i, minutes := range []int{10, 20} {
+		if offset := board.Departures[i].Time.Sub(now); offset < time.Duration(minutes-1)*time.Minute || offset > time.Duration(minutes+1)*time.Minute {
+			t.Errorf("expected a departure in %v minutes, got %+v", minutes, board.Departures[i])
+		}
+	}
+}
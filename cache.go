@@ -0,0 +1,34 @@
+package main
+
+import "encoding/json"
+import "time"
+
+// cacheEntry is the envelope in which both cache providers store values, it
+// keeps track of the moment after which the value is considered stale and
+// the moment after which it can't be served at all.
+type cacheEntry struct {
+	Fresh   int64
+	Expires int64
+	Value   json.RawMessage
+}
+
+func encodeEntry(value interface{}, ttlFresh, ttlExpires time.Duration) ([]byte, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return json.Marshal(cacheEntry{now.Add(ttlFresh).UnixNano(), now.Add(ttlExpires).UnixNano(), b})
+}
+
+func decodeEntry(b []byte, v interface{}) (found bool, stale bool, err error) {
+	entry := cacheEntry{}
+	if err = json.Unmarshal(b, &entry); err != nil {
+		return false, false, err
+	}
+	now := time.Now().UnixNano()
+	if now > entry.Expires {
+		return false, false, nil
+	}
+	return true, now > entry.Fresh, json.Unmarshal(entry.Value, v)
+}
@@ -0,0 +1,60 @@
+package main
+
+import "strconv"
+import "sort"
+import "time"
+
+// ScheduledDeparture is a departure of a trip from a stop. ServiceDate is the date of the schedule the trip
+// was taken from, the day before the one of its Time for trips past midnight.
+type ScheduledDeparture struct {
+	Time         time.Time
+	Direction    string
+	ServiceClass string
+	BlockID      string
+	ServiceDate  time.Time
+}
+
+// GetScheduledDepartures returns the next departures of a route from a stop after a time in the agency
+// timezone, following the service classes of the dates into the next day when needed. An empty direction
+// includes the departures of all of them.
+func (nb NextBus) GetScheduledDepartures(agencyTag, routeTag, stopTag, direction string, from time.Time, limit int) ([]ScheduledDeparture, error) {
+	schedules, err := nb.GetSchedules(agencyTag, routeTag)
+	if err != nil {
+		return nil, err
+	}
+	departures := []ScheduledDeparture{}
+	date := serviceDate(from)
+	// trips that go past midnight belong to the service date before, with epoch times over 24 hours
+	for _, day := range []time.Time{date.AddDate(0, 0, -1), date, date.AddDate(0, 0, 1)} {
+		for _, schedule := range serviceSchedules(schedules, day) {
+			if direction != "" && schedule.Direction != direction {
+				continue
+			}
+			for _, tr := range schedule.Tr {
+				for _, stop := range tr.Stop {
+					if stop.Tag != stopTag || stop.Content == "--" {
+						continue
+					}
+					epoch, err := strconv.Atoi(stop.EpochTime)
+					if err != nil {
+						return nil, err
+					}
+					if departure := scheduleTime(day, epoch); !departure.Before(from) {
+						departures = append(departures, ScheduledDeparture{departure, schedule.Direction, schedule.ServiceClass, tr.BlockID, day})
+					}
+				}
+			}
+		}
+	}
+	sort.Sort(byDepartureTime(departures))
+	if len(departures) > limit {
+		departures = departures[:limit]
+	}
+	return departures, nil
+}
+
+type byDepartureTime []ScheduledDeparture
+
+func (departures byDepartureTime) Len() int           { return len(departures) }
+func (departures byDepartureTime) Swap(i, j int)      { departures[i], departures[j] = departures[j], departures[i] }
+func (departures byDepartureTime) Less(i, j int) bool { return departures[i].Time.Before(departures[j].Time) }
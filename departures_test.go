@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+import "time"
+
+func TestScheduledDepartures(t *testing.T) {
+	nb := newAvailabilityNextBus("wkd")
+	thursday := time.Date(2026, 10, 15, 0, 10, 0, 0, time.UTC)
+	departures, err := nb.GetScheduledDepartures("sf-muni", "N", "2", "", thursday, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Time{
+		thursday.Add(50 * time.Minute), // the trip of wednesday past midnight
+		thursday.Add(7*time.Hour + 50*time.Minute),
+		thursday.Add(17*time.Hour + 50*time.Minute),
+	}
+	if len(departures) != len(expected) {
+		t.Fatalf("expected %v departures, got %+v", len(expected), departures)
+	}
+	for i, departure := range departures {
+		if !departure.Time.Equal(expected[i]) || departure.Direction != "Inbound" || departure.ServiceClass != "wkd" {
+			t.Errorf("expected departure %v at %v, got %+v", i, expected[i], departure)
+		}
+	}
+	if departures[0].BlockID != "3" {
+		t.Errorf("expected the block of the trip, got %+v", departures[0])
+	}
+}
+
+func TestScheduledDeparturesSkipTheStopsNotServed(t *testing.T) {
+	nb := newAvailabilityNextBus("wkd")
+	departures, err := nb.GetScheduledDepartures("sf-muni", "N", "1", "", time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// thursday's trip is the next service date, friday's isn't looked at
+	if len(departures) != 2 || departures[0].Time.Hour() != 17 || departures[0].Time.Minute() != 30 {
+		t.Errorf("expected the departures of the trips serving the stop, got %+v", departures)
+	}
+}
+
+func TestScheduledDeparturesOfADirection(t *testing.T) {
+	nb := newAvailabilityNextBus("wkd")
+	departures, err := nb.GetScheduledDepartures("sf-muni", "N", "2", "Outbound", time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(departures) != 0 {
+		t.Errorf("expected no departures for other directions, got %+v", departures)
+	}
+}
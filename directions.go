@@ -0,0 +1,63 @@
+package main
+
+import "github.com/geraz69/nextbus"
+
+type RouteDirection struct {
+	Tag      string
+	Title    string
+	Name     string
+	UseForUI bool
+	Stops    []OrderedStop
+}
+
+// OrderedStop is a stop in the order it is served by a direction, Previous and Next are the tags
+// of the stops before and after it, empty at the ends of the direction.
+type OrderedStop struct {
+	nextbus.Stop
+	Sequence int
+	Previous string
+	Next     string
+}
+
+// GetDirections returns the directions of a route with their stops in travel order.
+func (nb NextBus) GetDirections(agencyTag, routeTag string) ([]RouteDirection, error) {
+	config, err := nb.GetRouteConfig(agencyTag, routeTag)
+	if err != nil {
+		return nil, err
+	}
+	stops := map[string]nextbus.Stop{}
+	for _, stop := range config.Stop {
+		stops[stop.Tag] = stop
+	}
+	directions := []RouteDirection{}
+	for _, direction := range config.Direction {
+		ordered := []OrderedStop{}
+		for i, directionStop := range direction.Stop {
+			stop, ok := stops[directionStop.Tag]
+			if !ok {
+				stop = nextbus.Stop{Tag: directionStop.Tag}
+			}
+			orderedStop := OrderedStop{Stop: stop, Sequence: i + 1}
+			if i > 0 {
+				orderedStop.Previous = direction.Stop[i-1].Tag
+			}
+			if i < len(direction.Stop)-1 {
+				orderedStop.Next = direction.Stop[i+1].Tag
+			}
+			ordered = append(ordered, orderedStop)
+		}
+		directions = append(directions, RouteDirection{direction.Tag, direction.Title, direction.Name,
+			direction.UseForUI == "true", ordered})
+	}
+	return directions, nil
+}
+
+func (nb NextBus) GetDirection(agencyTag, routeTag, directionTag string) (*RouteDirection, error) {
+	directions, err := nb.GetDirections(agencyTag, routeTag)
+	for _, direction := range directions {
+		if direction.Tag == directionTag {
+			return &direction, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestDirections(t *testing.T) {
+	directions, err := newTestNextBus(loadTestFixtures(t)).GetDirections("sf-muni", "N")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(directions) != 2 || directions[1].Tag != "N____O_F00" || directions[1].Name != "Outbound" || !directions[1].UseForUI {
+		t.Fatalf("expected the inbound and outbound directions, got %+v", directions)
+	}
+	expected := []OrderedStop{{Sequence: 1, Previous: "", Next: "4448"}, {Sequence: 2, Previous: "6997", Next: "5205"},
+		{Sequence: 3, Previous: "4448", Next: ""}}
+	tags := []string{"6997", "4448", "5205"}
+	stops := directions[1].Stops
+	if len(stops) != len(expected) {
+		t.Fatalf("expected the stops %v, got %+v", tags, stops)
+	}
+	for i, stop := range stops {
+		if stop.Tag != tags[i] || stop.Sequence != expected[i].Sequence || stop.Previous != expected[i].Previous || stop.Next != expected[i].Next {
+			t.Errorf("expected the stop %v at %v after <%v> and before <%v>, got %+v", tags[i], expected[i].Sequence,
+				expected[i].Previous, expected[i].Next, stop)
+		}
+	}
+	if stops[0].Title != "Embarcadero Station Inbound" {
+		t.Errorf("expected the stops with the details of the route config, got %+v", stops[0])
+	}
+	if direction, _ := newTestNextBus(loadTestFixtures(t)).GetDirection("sf-muni", "N", "missing"); direction != nil {
+		t.Errorf("expected no direction, got %+v", direction)
+	}
+}
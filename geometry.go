@@ -0,0 +1,125 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "strconv"
+
+// FeatureCollection and the types below are the subset of GeoJSON (RFC 7946) used to describe
+// the geometry of a route, the members are lowercase as the format requires.
+type FeatureCollection struct {
+	Type       string                 `json:"type"`
+	BBox       []float64              `json:"bbox,omitempty"`
+	Properties map[string]interface{} `json:"properties"`
+	Features   []Feature              `json:"features"`
+}
+
+type Feature struct {
+	Type       string                 `json:"type"`
+	Geometry   Geometry               `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type Geometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// GetRouteGeometry returns the paths of a route as LineStrings and its stops as Points. Every stop
+// lists the tags of the directions that serve it, since NextBus paths are not tied to a direction.
+func (nb NextBus) GetRouteGeometry(agencyTag, routeTag string) (*FeatureCollection, error) {
+	config, err := nb.GetRouteConfig(agencyTag, routeTag)
+	if err != nil {
+		return nil, err
+	}
+	color, oppositeColor := hexColor(config.Color), hexColor(config.OppositeColor)
+	geometry := &FeatureCollection{
+		Type: "FeatureCollection",
+		Properties: map[string]interface{}{
+			"route":         config.Tag,
+			"title":         config.Title,
+			"color":         color,
+			"oppositeColor": oppositeColor,
+		},
+		Features: []Feature{},
+	}
+	latMin, latMinErr := strconv.ParseFloat(config.LatMin, 64)
+	latMax, latMaxErr := strconv.ParseFloat(config.LatMax, 64)
+	lonMin, lonMinErr := strconv.ParseFloat(config.LonMin, 64)
+	lonMax, lonMaxErr := strconv.ParseFloat(config.LonMax, 64)
+	if latMinErr == nil && latMaxErr == nil && lonMinErr == nil && lonMaxErr == nil {
+		geometry.BBox = []float64{lonMin, latMin, lonMax, latMax}
+	}
+	for _, path := range config.Path {
+		coordinates := [][]float64{}
+		for _, point := range path.Point {
+			if position, ok := coordinate(point.Lat, point.Lon); ok {
+				coordinates = append(coordinates, position)
+			}
+		}
+		if len(coordinates) < 2 {
+			continue
+		}
+		geometry.Features = append(geometry.Features, Feature{
+			Type:     "Feature",
+			Geometry: Geometry{"LineString", coordinates},
+			Properties: map[string]interface{}{
+				"kind":          "path",
+				"color":         color,
+				"oppositeColor": oppositeColor,
+			},
+		})
+	}
+	directions := stopDirections(config)
+	for _, stop := range config.Stop {
+		position, ok := coordinate(stop.Lat, stop.Lon)
+		if !ok {
+			continue
+		}
+		geometry.Features = append(geometry.Features, Feature{
+			Type:     "Feature",
+			Geometry: Geometry{"Point", position},
+			Properties: map[string]interface{}{
+				"kind":          "stop",
+				"tag":           stop.Tag,
+				"title":         stop.Title,
+				"stopId":        stop.StopId,
+				"direction":     directions[stop.Tag],
+				"color":         color,
+				"oppositeColor": oppositeColor,
+			},
+		})
+	}
+	return geometry, nil
+}
+
+// stopDirections maps the tag of every stop of a route to the tags of the directions that serve it.
+func stopDirections(config *nextbus.RouteConfig) map[string][]string {
+	directions := map[string][]string{}
+	for _, stop := range config.Stop {
+		directions[stop.Tag] = []string{}
+	}
+	for _, direction := range config.Direction {
+		for _, stop := range direction.Stop {
+			if tags, ok := directions[stop.Tag]; ok && !contains(tags, direction.Tag) {
+				directions[stop.Tag] = append(tags, direction.Tag)
+			}
+		}
+	}
+	return directions
+}
+
+// coordinate returns a GeoJSON position, which goes longitude first.
+func coordinate(lat, lon string) ([]float64, bool) {
+	latitude, latErr := strconv.ParseFloat(lat, 64)
+	longitude, lonErr := strconv.ParseFloat(lon, 64)
+	if latErr != nil || lonErr != nil {
+		return nil, false
+	}
+	return []float64{longitude, latitude}, true
+}
+
+func hexColor(color string) string {
+	if color == "" {
+		return ""
+	}
+	return "#" + color
+}
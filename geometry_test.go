@@ -0,0 +1,62 @@
+package main
+
+import "encoding/json"
+import "testing"
+
+func TestRouteGeometry(t *testing.T) {
+	geometry, err := newTestNextBus(loadTestFixtures(t)).GetRouteGeometry("sf-muni", "N")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(geometry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection := struct {
+		Type       string
+		BBox       []float64
+		Properties map[string]interface{}
+		Features   []struct {
+			Geometry struct {
+				Type        string
+				Coordinates json.RawMessage
+			}
+			Properties map[string]interface{}
+		}
+	}{}
+	if err = json.Unmarshal(b, &collection); err != nil {
+		t.Fatal(err)
+	}
+	if collection.Type != "FeatureCollection" || collection.Properties["color"] != "#003399" {
+		t.Errorf("expected a collection with the color of the route, got %s", b)
+	}
+	// the bounding box and the positions go longitude first
+	bbox := []float64{-122.5092, 37.7601699, -122.38798, 37.7932299}
+	if len(collection.BBox) != len(bbox) {
+		t.Fatalf("expected the bbox %v, got %v", bbox, collection.BBox)
+	}
+	for i := range bbox {
+		if collection.BBox[i] != bbox[i] {
+			t.Errorf("expected the bbox %v, got %v", bbox, collection.BBox)
+			break
+		}
+	}
+	if len(collection.Features) != 4 {
+		t.Fatalf("expected the path and the 3 stops, got %s", b)
+	}
+	path := collection.Features[0]
+	line := [][]float64{}
+	json.Unmarshal(path.Geometry.Coordinates, &line)
+	if path.Geometry.Type != "LineString" || len(line) != 3 || line[0][0] != -122.5091999 || line[0][1] != 37.7604699 {
+		t.Errorf("expected the path as a LineString, got %+v", path)
+	}
+	stop := collection.Features[2]
+	point := []float64{}
+	json.Unmarshal(stop.Geometry.Coordinates, &point)
+	if stop.Geometry.Type != "Point" || stop.Properties["tag"] != "4448" || len(point) != 2 || point[0] != -122.4664199 || point[1] != 37.7622399 {
+		t.Errorf("expected the stop 4448 as a Point, got %+v", stop)
+	}
+	if directions, _ := stop.Properties["direction"].([]interface{}); len(directions) != 2 {
+		t.Errorf("expected the stop to be served by both directions, got %+v", stop.Properties)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import "github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+import "google.golang.org/protobuf/proto"
+import "strconv"
+import "sort"
+import "time"
+import "log"
+
+// GetRealtimeFeed renders the cached predictions of an agency as GTFS-Realtime TripUpdates,
+// and the locations of its vehicles as VehiclePositions.
+func (nb NextBus) GetRealtimeFeed(agencyTag string) (*gtfs.FeedMessage, error) {
+	now := time.Now()
+	feed := &gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Incrementality:      gtfs.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(uint64(now.Unix())),
+		},
+	}
+	predictions, err := nb.GetCachedPredictions(agencyTag)
+	if err != nil {
+		return nil, err
+	}
+	tripUpdates := map[string]*gtfs.TripUpdate{}
+	tripIds := []string{}
+	for stop, stopPredictions := range predictions {
+		for _, prediction := range stopPredictions.Predictions() {
+			// predictions without a trip are still grouped by the vehicle that is serving them, and the ones
+			// without a vehicle either are a trip of their own
+			tripId := prediction.TripTag
+			if tripId == "" && prediction.Vehicle != "" {
+				tripId = "vehicle:" + prediction.Vehicle
+			} else if tripId == "" {
+				tripId = "prediction:" + stop.RouteTag + "/" + stop.StopTag + "/" + strconv.FormatInt(prediction.EpochTime, 10)
+			}
+			tripUpdate, ok := tripUpdates[tripId]
+			if !ok {
+				tripUpdate = &gtfs.TripUpdate{
+					Trip:      &gtfs.TripDescriptor{RouteId: proto.String(stop.RouteTag)},
+					Timestamp: proto.Uint64(uint64(now.Unix())),
+				}
+				if prediction.TripTag != "" {
+					tripUpdate.Trip.TripId = proto.String(prediction.TripTag)
+				}
+				if prediction.Vehicle != "" {
+					tripUpdate.Vehicle = &gtfs.VehicleDescriptor{Id: proto.String(prediction.Vehicle)}
+				}
+				tripUpdates[tripId] = tripUpdate
+				tripIds = append(tripIds, tripId)
+			}
+			event := &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(prediction.EpochTime / 1000)}
+			stopTimeUpdate := &gtfs.TripUpdate_StopTimeUpdate{StopId: proto.String(stop.StopTag)}
+			if prediction.IsDeparture {
+				stopTimeUpdate.Departure = event
+			} else {
+				stopTimeUpdate.Arrival = event
+			}
+			tripUpdate.StopTimeUpdate = append(tripUpdate.StopTimeUpdate, stopTimeUpdate)
+		}
+	}
+	sort.Strings(tripIds)
+	for _, tripId := range tripIds {
+		tripUpdate := tripUpdates[tripId]
+		// there are no stop sequences in the NextBus data, the predicted times give the order instead
+		sort.Sort(byEventTime(tripUpdate.StopTimeUpdate))
+		feed.Entity = append(feed.Entity, &gtfs.FeedEntity{Id: proto.String("trip:" + tripId), TripUpdate: tripUpdate})
+	}
+
+	vehicles, err := nb.GetVehicleLocations(agencyTag, "", 0)
+	if err != nil {
+		log.Printf("Vehicle positions for agency <%v> are not available: %v", agencyTag, err.Error())
+		return feed, nil
+	}
+	for _, vehicle := range vehicles.Vehicle {
+		position := &gtfs.VehiclePosition{
+			Trip:    &gtfs.TripDescriptor{RouteId: proto.String(vehicle.RouteTag)},
+			Vehicle: &gtfs.VehicleDescriptor{Id: proto.String(vehicle.Id)},
+			Position: &gtfs.Position{
+				Latitude:  proto.Float32(float32(vehicle.Lat)),
+				Longitude: proto.Float32(float32(vehicle.Lon)),
+				Speed:     proto.Float32(float32(vehicle.SpeedKmHr / 3.6)),
+			},
+			Timestamp: proto.Uint64(uint64(now.Unix() - int64(vehicle.SecsSinceReport))),
+		}
+		// NextBus reports a negative heading when it is unknown
+		if vehicle.Heading >= 0 {
+			position.Position.Bearing = proto.Float32(float32(vehicle.Heading))
+		}
+		feed.Entity = append(feed.Entity, &gtfs.FeedEntity{Id: proto.String("vehicle:" + vehicle.Id), Vehicle: position})
+	}
+	return feed, nil
+}
+
+type byEventTime []*gtfs.TripUpdate_StopTimeUpdate
+
+func (updates byEventTime) Len() int      { return len(updates) }
+func (updates byEventTime) Swap(i, j int) { updates[i], updates[j] = updates[j], updates[i] }
+func (updates byEventTime) Less(i, j int) bool {
+	return eventTime(updates[i]) < eventTime(updates[j])
+}
+
+func eventTime(update *gtfs.TripUpdate_StopTimeUpdate) int64 {
+	if update.Arrival != nil {
+		return *update.Arrival.Time
+	}
+	return *update.Departure.Time
+}
@@ -0,0 +1,69 @@
+package main
+
+import "github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+import "google.golang.org/protobuf/proto"
+import "testing"
+
+func TestRealtimeFeedEntities(t *testing.T) {
+	memory := NewMemoryUpstream()
+	memory.Predictions["sf-muni/N/5205"] = &StopPredictions{RouteTag: "N", StopTag: "5205", Direction: []PredictionsDirection{{
+		Prediction: []Prediction{
+			{EpochTime: 1760000300000, TripTag: "t1", Vehicle: "v1"},
+			{EpochTime: 1760000600000, Vehicle: "v2"},
+			{EpochTime: 1760000900000},
+			{EpochTime: 1760001200000, IsDeparture: true},
+		},
+	}}}
+	memory.Predictions["sf-muni/N/6997"] = &StopPredictions{RouteTag: "N", StopTag: "6997", Direction: []PredictionsDirection{{
+		Prediction: []Prediction{{EpochTime: 1760000000000, TripTag: "t1", Vehicle: "v1"}},
+	}}}
+	nb := newTestNextBus(memory)
+	for _, stopTag := range []string{"5205", "6997"} {
+		if _, err := nb.GetPredictions("sf-muni", "N", stopTag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	feed, err := nb.GetRealtimeFeed("sf-muni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := proto.Marshal(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := &gtfs.FeedMessage{}
+	if err = proto.Unmarshal(b, read); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"trip:t1":                              {"6997", "5205"},
+		"trip:vehicle:v2":                      {"5205"},
+		"trip:prediction:N/5205/1760000900000": {"5205"},
+		"trip:prediction:N/5205/1760001200000": {"5205"},
+	}
+	if len(read.GetEntity()) != len(expected) {
+		t.Fatalf("expected the entities %v, got %v", expected, read.GetEntity())
+	}
+	for _, entity := range read.GetEntity() {
+		stops, ok := expected[entity.GetId()]
+		updates := entity.GetTripUpdate().GetStopTimeUpdate()
+		if !ok || len(updates) != len(stops) {
+			t.Errorf("unexpected entity %v", entity)
+			continue
+		}
+		for i, update := range updates {
+			if update.GetStopId() != stops[i] {
+				t.Errorf("expected the stops %v in order in %v", stops, entity)
+			}
+		}
+		if entity.GetTripUpdate().GetTrip().GetRouteId() != "N" {
+			t.Errorf("expected the route of the entity %v", entity)
+		}
+	}
+	for _, entity := range read.GetEntity() {
+		if update := entity.GetTripUpdate().GetStopTimeUpdate()[0]; entity.GetId() == "trip:prediction:N/5205/1760001200000" &&
+			update.GetDeparture().GetTime() != 1760001200 {
+			t.Errorf("expected a departure in seconds, got %v", entity)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "strconv"
+import "sort"
+import "time"
+import "log"
+
+// headwaySampleStops is the number of stops of every direction which predictions are compared.
+const headwaySampleStops = 5
+
+// Consecutive vehicles closer than headwayBunching times the scheduled headway are bunched,
+// and further than headwayGap times it leave a gap.
+const headwayBunching = 0.25
+const headwayGap = 2.0
+
+// headwayWindow is the time around now which scheduled trips give the scheduled headway.
+const headwayWindow = time.Hour
+
+// headwayMaxOffRoute is how far (in meters) from the stops of its direction a vehicle can be to be placed
+// along it, the ones further away are laying over or off route.
+const headwayMaxOffRoute = 500.0
+
+type RouteHeadways struct {
+	Route      string
+	Time       time.Time
+	Directions []DirectionHeadways
+}
+
+// DirectionHeadways has the scheduled and observed (the median between consecutive vehicles) headways of
+// a direction in minutes, which are nil when unknown. Vehicles are the ones reporting the direction.
+type DirectionHeadways struct {
+	Direction        string
+	Title            string
+	Vehicles         []Vehicle
+	ScheduledHeadway *float64
+	ObservedHeadway  *float64
+	Events           []HeadwayEvent
+}
+
+// HeadwayEvent is either a bunching or a gap between the predicted arrivals of two consecutive vehicles
+// at a stop, the Headway between them is in minutes. For the vehicles placed by their positions the stop
+// is the one the leading vehicle is at now, and the following one is estimated to get there Headway later.
+type HeadwayEvent struct {
+	Type             string
+	Stop             string
+	StopTitle        string
+	Leading          string
+	Following        string
+	LeadingArrival   time.Time
+	FollowingArrival time.Time
+	Headway          float64
+}
+
+// GetRouteHeadways compares the predicted arrivals of consecutive vehicles at a few stops of every
+// direction of a route, and how far apart their positions are along the direction, with the headway
+// of the scheduled trips around now.
+func (nb NextBus) GetRouteHeadways(agencyTag, routeTag string) (*RouteHeadways, error) {
+	directions, err := nb.GetDirections(agencyTag, routeTag)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().In(nb.timezones.Location(agencyTag))
+	headways := &RouteHeadways{routeTag, now, []DirectionHeadways{}}
+	sampled := []PredictedStop{}
+	for _, direction := range directions {
+		for _, stop := range sampleStops(direction.Stops) {
+			sampled = append(sampled, PredictedStop{routeTag, stop.Tag})
+		}
+	}
+	predictions, err := nb.GetMultiStopPredictions(agencyTag, sampled)
+	if err != nil {
+		return nil, err
+	}
+	byStop := map[string]*StopPredictions{}
+	for _, stopPredictions := range predictions {
+		if stopPredictions.Predictions != nil {
+			byStop[stopPredictions.StopTag] = stopPredictions.Predictions
+		}
+	}
+	vehicles, err := nb.GetVehicleLocations(agencyTag, routeTag, 0)
+	if err != nil {
+		log.Printf("Headways of route <%v> without vehicles: %v", routeTag, err.Error())
+		vehicles = &VehicleLocations{[]Vehicle{}, 0}
+	}
+	schedules, err := nb.GetSchedules(agencyTag, routeTag)
+	if err != nil {
+		log.Printf("Headways of route <%v> without schedules: %v", routeTag, err.Error())
+	}
+	for _, direction := range directions {
+		directionHeadways := DirectionHeadways{direction.Tag, direction.Title, []Vehicle{}, nil, nil, []HeadwayEvent{}}
+		for _, vehicle := range vehicles.Vehicle {
+			if vehicle.DirTag == direction.Tag {
+				directionHeadways.Vehicles = append(directionHeadways.Vehicles, vehicle)
+			}
+		}
+		trips := scheduledTrips(schedules, direction.Name, now)
+		scheduled, hasSchedule := scheduledHeadway(trips)
+		if hasSchedule {
+			directionHeadways.ScheduledHeadway = &scheduled
+		}
+		observed := []float64{}
+		pairs := map[[2]string]bool{}
+		for _, stop := range sampleStops(direction.Stops) {
+			stopPredictions, ok := byStop[stop.Tag]
+			if !ok {
+				continue
+			}
+			arrivals := []Prediction{}
+			for _, prediction := range stopPredictions.Predictions() {
+				if prediction.DirTag == direction.Tag {
+					arrivals = append(arrivals, prediction)
+				}
+			}
+			for i := 1; i < len(arrivals); i++ {
+				leading, following := arrivals[i-1], arrivals[i]
+				headway := float64(following.EpochTime-leading.EpochTime) / 60000
+				observed = append(observed, headway)
+				// the same pair of vehicles is reported at the first stop it's found at
+				pair := [2]string{leading.Vehicle, following.Vehicle}
+				if pairs[pair] || !hasSchedule {
+					continue
+				}
+				event := HeadwayEvent{headwayEventType(headway, scheduled), stop.Tag, stop.Title, leading.Vehicle, following.Vehicle,
+					predictionTime(leading, now.Location()), predictionTime(following, now.Location()), headway}
+				if event.Type != "" {
+					pairs[pair] = true
+					directionHeadways.Events = append(directionHeadways.Events, event)
+				}
+			}
+		}
+		// the vehicles far from the sampled stops, or without predictions, are compared by their positions
+		if runTime, ok := scheduledRunTime(trips); ok {
+			for _, spacing := range vehicleSpacings(direction.Stops, directionHeadways.Vehicles, runTime) {
+				observed = append(observed, spacing.headway)
+				pair := [2]string{spacing.leading.Id, spacing.following.Id}
+				if pairs[pair] || !hasSchedule {
+					continue
+				}
+				event := HeadwayEvent{headwayEventType(spacing.headway, scheduled), spacing.stop.Tag, spacing.stop.Title,
+					spacing.leading.Id, spacing.following.Id, now, now.Add(time.Duration(spacing.headway * float64(time.Minute))), spacing.headway}
+				if event.Type != "" {
+					pairs[pair] = true
+					directionHeadways.Events = append(directionHeadways.Events, event)
+				}
+			}
+		}
+		if len(observed) > 0 {
+			sort.Float64s(observed)
+			median := observed[len(observed)/2]
+			directionHeadways.ObservedHeadway = &median
+		}
+		headways.Directions = append(headways.Directions, directionHeadways)
+	}
+	return headways, nil
+}
+
+// sampleStops picks stops spread along a direction, leaving out the last one where vehicles finish their trips.
+func sampleStops(stops []OrderedStop) []OrderedStop {
+	if len(stops) > 1 {
+		stops = stops[:len(stops)-1]
+	}
+	if len(stops) <= headwaySampleStops {
+		return stops
+	}
+	sampled := []OrderedStop{}
+	for i := 0; i < headwaySampleStops; i++ {
+		sampled = append(sampled, stops[i*(len(stops)-1)/(headwaySampleStops-1)])
+	}
+	return sampled
+}
+
+// headwayEventType tells whether a headway is a bunching or a gap for the scheduled one, empty if neither.
+func headwayEventType(headway, scheduled float64) string {
+	switch {
+	case headway < headwayBunching*scheduled:
+		return "bunching"
+	case headway > headwayGap*scheduled:
+		return "gap"
+	}
+	return ""
+}
+
+// scheduledTrip is the start and end of a scheduled trip.
+type scheduledTrip struct {
+	start time.Time
+	end   time.Time
+}
+
+// scheduledTrips returns the scheduled trips of a direction starting around a time, looking at the service
+// of the date and the trips of the day before past midnight, the earliest first.
+func scheduledTrips(schedules []nextbus.Schedule, directionName string, at time.Time) []scheduledTrip {
+	trips := []scheduledTrip{}
+	date := serviceDate(at)
+	for _, day := range []time.Time{date.AddDate(0, 0, -1), date} {
+		for _, schedule := range serviceSchedules(schedules, day) {
+			if schedule.Direction != directionName {
+				continue
+			}
+			spans, err := tripSpans(schedule)
+			if err != nil {
+				log.Print(err.Error())
+				continue
+			}
+			for _, span := range spans {
+				start := scheduleTime(day, span.start)
+				if start.After(at.Add(-headwayWindow)) && start.Before(at.Add(headwayWindow)) {
+					trips = append(trips, scheduledTrip{start, scheduleTime(day, span.end)})
+				}
+			}
+		}
+	}
+	sort.Sort(byStart(trips))
+	return trips
+}
+
+// scheduledHeadway is the median time in minutes between the starts of consecutive scheduled trips.
+func scheduledHeadway(trips []scheduledTrip) (float64, bool) {
+	if len(trips) < 2 {
+		return 0, false
+	}
+	gaps := []float64{}
+	for i := 1; i < len(trips); i++ {
+		gaps = append(gaps, trips[i].start.Sub(trips[i-1].start).Minutes())
+	}
+	sort.Float64s(gaps)
+	return gaps[len(gaps)/2], true
+}
+
+// scheduledRunTime is the median time in minutes that the scheduled trips take from end to end.
+func scheduledRunTime(trips []scheduledTrip) (float64, bool) {
+	runTimes := []float64{}
+	for _, trip := range trips {
+		if trip.end.After(trip.start) {
+			runTimes = append(runTimes, trip.end.Sub(trip.start).Minutes())
+		}
+	}
+	if len(runTimes) == 0 {
+		return 0, false
+	}
+	sort.Float64s(runTimes)
+	return runTimes[len(runTimes)/2], true
+}
+
+// vehicleSpacing is how far apart in minutes two consecutive vehicles of a direction are, stop being
+// the one the leading vehicle is at.
+type vehicleSpacing struct {
+	leading   Vehicle
+	following Vehicle
+	stop      OrderedStop
+	headway   float64
+}
+
+// placedVehicle is a vehicle at the closest stop of a direction, along is the distance to it from the first stop.
+type placedVehicle struct {
+	Vehicle
+	stop  int
+	along float64
+}
+
+// vehicleSpacings places the vehicles at the closest stop of a direction and turns the distance between
+// consecutive ones into minutes, as the share of the length of the direction of the scheduled run time.
+func vehicleSpacings(stops []OrderedStop, vehicles []Vehicle, runTime float64) []vehicleSpacing {
+	positions := make([]*stopPosition, len(stops))
+	along := make([]float64, len(stops))
+	var previous *stopPosition
+	for i, stop := range stops {
+		if i > 0 {
+			along[i] = along[i-1]
+		}
+		lat, latErr := strconv.ParseFloat(stop.Lat, 64)
+		lon, lonErr := strconv.ParseFloat(stop.Lon, 64)
+		if latErr != nil || lonErr != nil {
+			continue
+		}
+		positions[i] = &stopPosition{lat, lon}
+		if previous != nil {
+			along[i] += distance(previous.lat, previous.lon, lat, lon)
+		}
+		previous = positions[i]
+	}
+	spacings := []vehicleSpacing{}
+	if len(stops) == 0 || along[len(stops)-1] == 0 {
+		return spacings
+	}
+	placed := []placedVehicle{}
+	for _, vehicle := range vehicles {
+		closest, closestDistance := -1, headwayMaxOffRoute
+		for i, position := range positions {
+			if position == nil {
+				continue
+			}
+			if d := distance(vehicle.Lat, vehicle.Lon, position.lat, position.lon); d <= closestDistance {
+				closest, closestDistance = i, d
+			}
+		}
+		if closest >= 0 {
+			placed = append(placed, placedVehicle{vehicle, closest, along[closest]})
+		}
+	}
+	sort.Sort(byAlong(placed))
+	for i := 1; i < len(placed); i++ {
+		leading, following := placed[i-1], placed[i]
+		headway := (leading.along - following.along) / along[len(stops)-1] * runTime
+		spacings = append(spacings, vehicleSpacing{leading.Vehicle, following.Vehicle, stops[leading.stop], headway})
+	}
+	return spacings
+}
+
+func predictionTime(prediction Prediction, location *time.Location) time.Time {
+	return time.Unix(0, prediction.EpochTime*int64(time.Millisecond)).In(location)
+}
+
+type byStart []scheduledTrip
+
+func (trips byStart) Len() int           { return len(trips) }
+func (trips byStart) Swap(i, j int)      { trips[i], trips[j] = trips[j], trips[i] }
+func (trips byStart) Less(i, j int) bool { return trips[i].start.Before(trips[j].start) }
+
+// byAlong sorts the vehicles the furthest along the direction first.
+type byAlong []placedVehicle
+
+func (vehicles byAlong) Len() int           { return len(vehicles) }
+func (vehicles byAlong) Swap(i, j int)      { vehicles[i], vehicles[j] = vehicles[j], vehicles[i] }
+func (vehicles byAlong) Less(i, j int) bool { return vehicles[i].along > vehicles[j].along }
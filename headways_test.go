@@ -0,0 +1,60 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "testing"
+import "time"
+
+func TestVehicleSpacings(t *testing.T) {
+	stops := []OrderedStop{}
+	// 5 stops about 1.1 km apart along the equator, the last one without a location
+	for i, lon := range []string{"0", "0.01", "0.02", "0.03", ""} {
+		stops = append(stops, OrderedStop{Stop: nextbus.Stop{Tag: string(rune('A' + i)), Lat: "0", Lon: lon}})
+	}
+	vehicles := []Vehicle{
+		{Id: "1", Lon: 0.0301},
+		{Id: "2", Lon: 0.0001},
+		{Id: "3", Lon: 0.0099},
+		{Id: "4", Lat: 1, Lon: 0.02},
+	}
+	spacings := vehicleSpacings(stops, vehicles, 30)
+	if len(spacings) != 2 {
+		t.Fatalf("expected the spacings of the 3 vehicles on route, got %+v", spacings)
+	}
+	first, second := spacings[0], spacings[1]
+	if first.leading.Id != "1" || first.following.Id != "3" || first.stop.Tag != "D" || first.headway < 19.9 || first.headway > 20.1 {
+		t.Errorf("expected vehicle 3 20 minutes behind vehicle 1 at D, got %+v", first)
+	}
+	if second.leading.Id != "3" || second.following.Id != "2" || second.headway < 9.9 || second.headway > 10.1 {
+		t.Errorf("expected vehicle 2 10 minutes behind vehicle 3, got %+v", second)
+	}
+}
+
+func TestScheduledHeadwayAndRunTime(t *testing.T) {
+	schedules := []nextbus.Schedule{{ServiceClass: "wkd", Direction: "Inbound", Tr: []nextbus.Tr{
+		trip("1", hours(7.5), hours(8)),
+		trip("2", hours(7.75), hours(8.25)),
+		trip("3", hours(8), hours(8.6)),
+		trip("4", hours(12), hours(12.5)),
+	}}, {ServiceClass: "wkd", Direction: "Outbound", Tr: []nextbus.Tr{trip("5", hours(8), hours(9))}}}
+	trips := scheduledTrips(schedules, "Inbound", time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC))
+	if len(trips) != 3 {
+		t.Fatalf("expected the trips starting within an hour, got %+v", trips)
+	}
+	if headway, ok := scheduledHeadway(trips); !ok || headway != 15 {
+		t.Errorf("expected a 15 minutes headway, got %v", headway)
+	}
+	if runTime, ok := scheduledRunTime(trips); !ok || runTime != 30 {
+		t.Errorf("expected a 30 minutes run time, got %v", runTime)
+	}
+	if _, ok := scheduledHeadway(trips[:1]); ok {
+		t.Error("a single trip has no headway")
+	}
+}
+
+func TestHeadwayEventType(t *testing.T) {
+	for headway, expected := range map[float64]string{2: "bunching", 10: "", 30: "", 31: "gap"} {
+		if eventType := headwayEventType(headway, 15); eventType != expected {
+			t.Errorf("headway %v: expected %q, got %q", headway, expected, eventType)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import "encoding/json"
+import "bytes"
+import "sync"
+import "time"
+import "log"
+
+// Hub fans out the updates of topics to their subscribers. Every topic has a single poller, started by
+// its first subscriber and stopped when the last one leaves, which publishes the value of the topic
+// only when it changes.
+type Hub struct {
+	mutex    *sync.Mutex
+	topics   map[string]*hubTopic
+	interval time.Duration
+	poll     func(topic string) (interface{}, error)
+}
+
+type hubTopic struct {
+	subscribers map[chan []byte]bool
+	last        []byte
+	done        chan bool
+}
+
+func NewHub(interval time.Duration, poll func(topic string) (interface{}, error)) *Hub {
+	return &Hub{&sync.Mutex{}, map[string]*hubTopic{}, interval, poll}
+}
+
+// Subscribe returns the channel where the updates of a topic are delivered, starting with the last
+// one when the topic is already being polled. The channel only holds the latest update, so slow
+// subscribers skip the ones they didn't get to read.
+func (hub *Hub) Subscribe(topic string) chan []byte {
+	updates := make(chan []byte, 1)
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	t, ok := hub.topics[topic]
+	if !ok {
+		t = &hubTopic{map[chan []byte]bool{}, nil, make(chan bool)}
+		hub.topics[topic] = t
+		go hub.run(topic, t)
+	}
+	t.subscribers[updates] = true
+	if t.last != nil {
+		updates <- t.last
+	}
+	return updates
+}
+
+func (hub *Hub) Unsubscribe(topic string, updates chan []byte) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	t, ok := hub.topics[topic]
+	if !ok {
+		return
+	}
+	delete(t.subscribers, updates)
+	if len(t.subscribers) == 0 {
+		close(t.done)
+		delete(hub.topics, topic)
+	}
+}
+
+func (hub *Hub) run(topic string, t *hubTopic) {
+	ticker := time.NewTicker(hub.interval)
+	defer ticker.Stop()
+	for {
+		hub.publish(topic, t)
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hub *Hub) publish(topic string, t *hubTopic) {
+	value, err := hub.poll(topic)
+	if err != nil {
+		log.Printf("Polling topic <%v> failed: %v", topic, err.Error())
+		return
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if bytes.Equal(data, t.last) {
+		return
+	}
+	t.last = data
+	for updates := range t.subscribers {
+		// replace the update the subscriber hasn't read yet, if any
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- data
+	}
+}
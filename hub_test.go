@@ -0,0 +1,73 @@
+package main
+
+import "encoding/json"
+import "sync/atomic"
+import "testing"
+import "time"
+
+// newCountingHub publishes the number of times a topic was polled, so every poll is an update.
+func newCountingHub() (*Hub, *int32) {
+	polls := new(int32)
+	return NewHub(10*time.Millisecond, func(topic string) (interface{}, error) {
+		return atomic.AddInt32(polls, 1), nil
+	}), polls
+}
+
+func readUpdate(t *testing.T, updates chan []byte) int32 {
+	select {
+	case data := <-updates:
+		var value int32
+		if err := json.Unmarshal(data, &value); err != nil {
+			t.Fatal(err)
+		}
+		return value
+	case <-time.After(time.Second):
+		t.Fatal("expected an update")
+	}
+	return 0
+}
+
+func TestHubSubscriptions(t *testing.T) {
+	hub, polls := newCountingHub()
+	first := hub.Subscribe("topic")
+	if value := readUpdate(t, first); value < 1 {
+		t.Errorf("expected the first update, got %v", value)
+	}
+	// a later subscriber starts with the last update
+	second := hub.Subscribe("topic")
+	if value := readUpdate(t, second); value < 1 {
+		t.Errorf("expected the last update, got %v", value)
+	}
+	hub.Unsubscribe("topic", first)
+	previous := readUpdate(t, second)
+	if value := readUpdate(t, second); value <= previous {
+		t.Errorf("expected the updates to go on while somebody is subscribed, got %v after %v", value, previous)
+	}
+	hub.Unsubscribe("topic", second)
+	hub.mutex.Lock()
+	_, ok := hub.topics["topic"]
+	hub.mutex.Unlock()
+	if ok {
+		t.Error("expected the topic to be gone with its last subscriber")
+	}
+	time.Sleep(30 * time.Millisecond)
+	stopped := atomic.LoadInt32(polls)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(polls); n != stopped {
+		t.Errorf("expected the poller to stop with the last subscriber, polled %v times more", n-stopped)
+	}
+}
+
+func TestHubKeepsTheLatestUpdateForSlowSubscribers(t *testing.T) {
+	hub, polls := newCountingHub()
+	updates := hub.Subscribe("topic")
+	defer hub.Unsubscribe("topic", updates)
+	time.Sleep(100 * time.Millisecond)
+	if len(updates) > 1 {
+		t.Fatalf("expected a single update waiting, got %v", len(updates))
+	}
+	latest := atomic.LoadInt32(polls)
+	if value := readUpdate(t, updates); value < 3 || value < latest-1 {
+		t.Errorf("expected the latest update of %v, got %v", latest, value)
+	}
+}
@@ -1,56 +1,88 @@
 package main
 
 import "github.com/geraz69/lru"
-import "encoding/json"
 import "math/rand"
 import "errors"
-import "bytes"
 import "sync"
 import "time"
 
+// inProcessDurableTTL bounds the entries stored for longer than ttlHard, their actual expiration is kept in the entry.
+const inProcessDurableTTL = 30 * 24 * time.Hour
+
+// InProcessCache keeps the entries stored for longer than ttlHard apart in the durable LRU, so that they
+// are neither expired after ttlHard nor evicted by the churn of the data.
 type InProcessCache struct {
-	data    lru.LRU
-	lock    lru.LRU
-	ttlData time.Duration
-	ttlLock time.Duration
-	mutex   sync.Mutex
+	data        lru.LRU
+	durable     lru.LRU
+	lock        lru.LRU
+	ttlData     time.Duration
+	ttlHard     time.Duration
+	ttlNegative time.Duration
+	ttlLock     time.Duration
+	mutex       *sync.Mutex
 }
 
 type InProcessCounter struct {
 	lruCounter lru.LRUCounter
 }
 
-func NewInProcessCache(capacity int, ttlData time.Duration, ttlLock time.Duration) InProcessCache {
+func NewInProcessCache(capacity int, ttlData, ttlHard, ttlNegative, ttlLock time.Duration) InProcessCache {
 	return InProcessCache{
-		data:    *lru.New(nil, nil, capacity, ttlData),
-		lock:    *lru.New(nil, nil, capacity, ttlLock),
-		mutex:   sync.Mutex{},
-		ttlData: ttlData,
-		ttlLock: ttlLock,
+		data:        *lru.New(nil, nil, capacity, ttlHard),
+		durable:     *lru.New(nil, nil, capacity, inProcessDurableTTL),
+		lock:        *lru.New(nil, nil, capacity, ttlLock),
+		mutex:       &sync.Mutex{},
+		ttlData:     ttlData,
+		ttlHard:     ttlHard,
+		ttlNegative: ttlNegative,
+		ttlLock:     ttlLock,
 	}
 }
 
-func (cache InProcessCache) Get(key string, v interface{}) (bool, error) {
+func (cache InProcessCache) Get(key string, v interface{}) (bool, bool, error) {
 	b, ok := cache.data.Get(lru.Key(key))
 	if b == nil || !ok {
-		return false, nil
+		if b, ok = cache.durable.Get(lru.Key(key)); b == nil || !ok {
+			return false, false, nil
+		}
 	}
-	decoder := json.NewDecoder(bytes.NewReader(b.([]byte)))
-	err := decoder.Decode(&v)
-	return true, err
+	return decodeEntry(b.([]byte), v)
 }
 
 func (cache InProcessCache) Set(key string, value interface{}) error {
+	return cache.set(key, value, cache.ttlData, cache.ttlHard)
+}
+
+// SetFor stores a value that is fresh for the given ttl, it still expires after ttlHard unless the ttl is longer.
+func (cache InProcessCache) SetFor(key string, value interface{}, ttl time.Duration) error {
+	if ttl > cache.ttlHard {
+		return cache.set(key, value, ttl, ttl)
+	}
+	return cache.set(key, value, ttl, cache.ttlHard)
+}
+
+func (cache InProcessCache) SetNegative(key string, value interface{}) error {
+	return cache.set(key, value, cache.ttlNegative, cache.ttlNegative)
+}
+
+func (cache InProcessCache) set(key string, value interface{}, ttlFresh, ttlExpires time.Duration) error {
 	if value == nil {
 		panic("value shouldn't be nil")
 	}
-	b := bytes.NewBuffer(nil)
-	encoder := json.NewEncoder(b)
-	err := encoder.Encode(value)
-	if err == nil {
-		cache.data.Set(lru.Key(key), lru.Value(b.Bytes()))
+	b, err := encodeEntry(value, ttlFresh, ttlExpires)
+	if err != nil {
+		return err
 	}
-	return err
+	stored, other := &cache.data, &cache.durable
+	if ttlExpires > cache.ttlHard {
+		stored, other = &cache.durable, &cache.data
+	}
+	// a previous value of the key in the other LRU would shadow or outlive this one
+	if existing, _ := other.Get(lru.Key(key)); existing != nil {
+		other.Set(lru.Key(key), nil)
+	}
+	stored.Set(lru.Key(key), lru.Value(b))
+	return nil
 }
 
 func (cache InProcessCache) Lock(key string) (int, error) {
@@ -1,6 +1,7 @@
 package main
 
 import "github.com/emicklei/go-restful"
+import "github.com/geraz69/nextbus"
 import "github.com/pelletier/go-toml"
 import "net/http"
 import "errors"
@@ -10,12 +11,25 @@ import "log"
 import "os"
 
 type Cacher interface {
-	Get(key string, value interface{}) (found bool, err error)
+	Get(key string, value interface{}) (found bool, stale bool, err error)
 	Set(key string, value interface{}) (err error)
+	SetFor(key string, value interface{}, ttl time.Duration) (err error)
+	SetNegative(key string, value interface{}) (err error)
 	Lock(key string) (int, error)
 	Unlock(key string, lockId int)
 }
 
+type Upstream interface {
+	GetAgencies() ([]nextbus.Agency, error)
+	GetRoutes(agencyTag string) ([]nextbus.Route, error)
+	GetRouteConfig(agencyTag, routeTag string) (nextbus.RouteConfig, error)
+	GetPredictions(agencyTag, routeTag, stopTag string) (*StopPredictions, error)
+	GetMultiStopPredictions(agencyTag string, stops []PredictedStop) (map[PredictedStop]*StopPredictions, error)
+	GetSchedules(agencyTag, routeTag string) ([]nextbus.Schedule, error)
+	GetVehicleLocations(agencyTag, routeTag string, since int64) (*VehicleLocations, error)
+	GetMessages(agencyTag string) ([]Message, error)
+}
+
 type Incrementer interface {
 	Get(key string) (v int, found bool, err error)
 	Incr(key string) (err error)
@@ -55,6 +69,28 @@ func main() {
 		return
 	}
 
+	ttlHard, err := time.ParseDuration(config.Get("cache.ttlHard").(string))
+	if err != nil {
+		err = errors.New("Unable to read ttlHard: " + err.Error())
+		return
+	}
+	if ttlHard < ttlData {
+		err = errors.New("ttlHard should be greater than or equal to ttlData")
+		return
+	}
+
+	ttlNegative, err := time.ParseDuration(config.Get("cache.ttlNegative").(string))
+	if err != nil {
+		err = errors.New("Unable to read ttlNegative: " + err.Error())
+		return
+	}
+
+	ttlVehicles, err := time.ParseDuration(config.Get("cache.ttlVehicles").(string))
+	if err != nil {
+		err = errors.New("Unable to read ttlVehicles: " + err.Error())
+		return
+	}
+
 	ttlLock, err := time.ParseDuration(config.Get("cache.ttlLock").(string))
 	if err != nil {
 		err = errors.New("Unable to read ttlLock: " + err.Error())
@@ -64,21 +100,193 @@ func main() {
 	switch provider {
 	case "lru":
 		capacity := config.Get("lru.capacity").(int64)
-		cache = NewInProcessCache(int(capacity), ttlData, ttlLock)
+		cache = NewInProcessCache(int(capacity), ttlData, ttlHard, ttlNegative, ttlLock)
 		incr = NewInProcessCounter(int(capacity))
 	case "redis":
 		url := config.Get("redis.url").(string)
-		cache = NewRedisCache(url, ttlData, ttlLock)
+		cache = NewRedisCache(url, ttlData, ttlHard, ttlNegative, ttlLock)
 		incr = NewRedisCounter(url)
 	default:
 		err = errors.New("unknown or unspecified cache provider")
 		return
 	}
 
+	var upstream Upstream
+
+	switch config.Get("upstream.provider") {
+	case "nextbus":
+		upstream = NextBusUpstream{}
+		switch mode := config.Get("upstream.mode"); mode {
+		case "live":
+		case "record", "replay":
+			fixtures := config.Get("upstream.fixtures").(string)
+			http.DefaultTransport = NewFixturesTransport(mode.(string), fixtures, http.DefaultTransport)
+		default:
+			err = errors.New("unknown or unspecified upstream mode")
+			return
+		}
+	case "memory":
+		path := config.Get("memory.path").(string)
+		upstream, err = LoadMemoryUpstream(path)
+		if err != nil {
+			err = errors.New("Unable to load memory upstream: " + err.Error())
+			return
+		}
+	case "gtfs":
+		path := config.Get("gtfs.path").(string)
+		upstream, err = LoadGTFSUpstream(path)
+		if err != nil {
+			err = errors.New("Unable to load gtfs feed: " + err.Error())
+			return
+		}
+	default:
+		err = errors.New("unknown or unspecified upstream provider")
+		return
+	}
+
+	fallback, err := time.LoadLocation(config.Get("agencies.timezone").(string))
+	if err != nil {
+		err = errors.New("Unable to read agencies timezone: " + err.Error())
+		return
+	}
+	locations := map[string]*time.Location{}
+	if timezones, ok := config.Get("agencies.timezones").(interface {
+		Keys() []string
+	}); ok {
+		for _, agencyTag := range timezones.Keys() {
+			if locations[agencyTag], err = time.LoadLocation(config.Get("agencies.timezones." + agencyTag).(string)); err != nil {
+				err = errors.New("Unable to read timezone of agency " + agencyTag + ": " + err.Error())
+				return
+			}
+		}
+	}
+
+	tolerance, err := time.ParseDuration(config.Get("agencies.tolerance").(string))
+	if err != nil {
+		err = errors.New("Unable to read tolerance: " + err.Error())
+		return
+	}
+
+	streamInterval, err := time.ParseDuration(config.Get("stream.interval").(string))
+	if err != nil {
+		err = errors.New("Unable to read stream interval: " + err.Error())
+		return
+	}
+
+	heartbeat, err := time.ParseDuration(config.Get("stream.heartbeat").(string))
+	if err != nil {
+		err = errors.New("Unable to read stream heartbeat: " + err.Error())
+		return
+	}
+
+	streamOrigins := []string{}
+	for _, origin := range config.Get("stream.origins").([]interface{}) {
+		streamOrigins = append(streamOrigins, origin.(string))
+	}
+
+	webhooksInterval, err := time.ParseDuration(config.Get("webhooks.interval").(string))
+	if err != nil {
+		err = errors.New("Unable to read webhooks interval: " + err.Error())
+		return
+	}
+
+	webhooksTtl, err := time.ParseDuration(config.Get("webhooks.ttl").(string))
+	if err != nil {
+		err = errors.New("Unable to read webhooks ttl: " + err.Error())
+		return
+	}
+	if err = checkRetention(provider, "Webhooks ttl", webhooksTtl); err != nil {
+		return
+	}
+
+	accuracyStops := []string{}
+	for _, stop := range config.Get("accuracy.stops").([]interface{}) {
+		accuracyStops = append(accuracyStops, stop.(string))
+	}
+	recordedStops, err := ParseRecordedStops(accuracyStops)
+	if err != nil {
+		err = errors.New("Unable to read accuracy stops: " + err.Error())
+		return
+	}
+
+	accuracyInterval, err := time.ParseDuration(config.Get("accuracy.interval").(string))
+	if err != nil {
+		err = errors.New("Unable to read accuracy interval: " + err.Error())
+		return
+	}
+
+	accuracyRetention, err := time.ParseDuration(config.Get("accuracy.retention").(string))
+	if err != nil {
+		err = errors.New("Unable to read accuracy retention: " + err.Error())
+		return
+	}
+	if err = checkRetention(provider, "Accuracy retention", accuracyRetention); err != nil {
+		return
+	}
+
+	onTimeRoutes := []string{}
+	for _, route := range config.Get("ontime.routes").([]interface{}) {
+		onTimeRoutes = append(onTimeRoutes, route.(string))
+	}
+	recordedRoutes, err := ParseRecordedRoutes(onTimeRoutes)
+	if err != nil {
+		err = errors.New("Unable to read on-time routes: " + err.Error())
+		return
+	}
+
+	onTimeInterval, err := time.ParseDuration(config.Get("ontime.interval").(string))
+	if err != nil {
+		err = errors.New("Unable to read on-time interval: " + err.Error())
+		return
+	}
+
+	onTimeRetention, err := time.ParseDuration(config.Get("ontime.retention").(string))
+	if err != nil {
+		err = errors.New("Unable to read on-time retention: " + err.Error())
+		return
+	}
+	if err = checkRetention(provider, "On-time retention", onTimeRetention); err != nil {
+		return
+	}
+
+	archiveAgencies := []string{}
+	for _, agency := range config.Get("archive.agencies").([]interface{}) {
+		archiveAgencies = append(archiveAgencies, agency.(string))
+	}
+
+	archiveInterval, err := time.ParseDuration(config.Get("archive.interval").(string))
+	if err != nil {
+		err = errors.New("Unable to read archive interval: " + err.Error())
+		return
+	}
+
+	archiveRetention, err := time.ParseDuration(config.Get("archive.retention").(string))
+	if err != nil {
+		err = errors.New("Unable to read archive retention: " + err.Error())
+		return
+	}
+
 	ws := new(restful.WebService)
 	ws.Path("/api").Consumes(restful.MIME_JSON).Produces(restful.MIME_JSON)
 
-	bootstrapNextBusService(ws, cache)
+	nextBus := NewNextBus(cache, upstream, ttlVehicles, NewTimezones(fallback, locations), tolerance)
+
+	bootstrapNextBusService(ws, nextBus)
+	bootstrapRealtimeService(ws, nextBus)
+	bootstrapStreamService(ws, NewHub(streamInterval, func(topic string) (interface{}, error) {
+		return nextBus.PollTopic(topic, streamInterval)
+	}), heartbeat, streamOrigins)
+	webhooks := NewWebhooks(nextBus, config.Get("webhooks.secret").(string), webhooksInterval, webhooksTtl)
+	go webhooks.Evaluate()
+	bootstrapWebhooksService(ws, webhooks)
+	recorder := NewAccuracyRecorder(nextBus, recordedStops, accuracyInterval, accuracyRetention)
+	go recorder.Record()
+	onTime := NewOnTimeRecorder(nextBus, recordedRoutes, onTimeInterval, onTimeRetention)
+	go onTime.Record()
+	bootstrapAnalyticsService(ws, nextBus, recorder, onTime)
+	archive := NewArchive(nextBus, config.Get("archive.dir").(string), archiveAgencies, archiveInterval, archiveRetention)
+	go archive.Run()
+	bootstrapArchiveService(ws, archive, heartbeat)
 	bootstrapStatsService(ws, incr)
 
 	restful.Add(ws)
@@ -86,3 +294,12 @@ func main() {
 	port := config.Get("service.port").(int64)
 	http.ListenAndServe(fmt.Sprintf(":%v", port), nil)
 }
+
+// checkRetention tells whether the cache provider can keep entries for as long as a setting asks,
+// the lru provider doesn't keep them longer than inProcessDurableTTL.
+func checkRetention(provider interface{}, name string, retention time.Duration) error {
+	if provider == "lru" && retention > inProcessDurableTTL {
+		return errors.New(name + " should be at most " + inProcessDurableTTL.String() + " with the lru cache provider")
+	}
+	return nil
+}
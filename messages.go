@@ -0,0 +1,54 @@
+package main
+
+import "log"
+
+// Message is a service alert of an agency, like a detour or an outage. Routes lists the tags of the
+// affected routes unless AllRoutes is set, Stops the stops where it is shown when it's restricted to some.
+// Start and End are epochs in milliseconds, or 0 when the message has no boundary.
+type Message struct {
+	Id        string
+	Priority  string
+	Text      string
+	AllRoutes bool
+	Routes    []string
+	Stops     []MessageStop
+	Start     int64
+	End       int64
+}
+
+type MessageStop struct {
+	RouteTag string
+	StopTag  string
+	Title    string
+}
+
+// GetMessages returns the messages of an agency, only those affecting the given route if it's not empty.
+func (nb NextBus) GetMessages(agencyTag, routeTag string) ([]Message, error) {
+	value := []Message{}
+	err := nb.cached("agencies/"+agencyTag+"/messages", &value, func() (interface{}, error) {
+		log.Printf("Fetching messages for agency: %v", agencyTag)
+		return nb.upstream.GetMessages(agencyTag)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if routeTag == "" {
+		return value, nil
+	}
+	messages := []Message{}
+	for _, message := range value {
+		if message.AllRoutes || contains(message.Routes, routeTag) {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
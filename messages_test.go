@@ -0,0 +1,51 @@
+package main
+
+import "net/http"
+import "testing"
+
+func TestNextBusMessages(t *testing.T) {
+	transport := http.DefaultTransport
+	http.DefaultTransport = NewFixturesTransport("replay", "fixtures/nextbus", nil)
+	defer func() { http.DefaultTransport = transport }()
+	messages, err := NextBusUpstream{}.GetMessages("sf-muni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected the messages repeated under every route once, got %+v", messages)
+	}
+	if all := messages[0]; all.Id != "21438" || !all.AllRoutes || len(all.Routes) != 0 {
+		t.Errorf("expected a message for all the routes, got %+v", all)
+	}
+	shuttle := messages[1]
+	if shuttle.Id != "21502" || shuttle.AllRoutes || len(shuttle.Routes) != 2 || shuttle.Routes[0] != "N" || shuttle.Routes[1] != "KT" {
+		t.Errorf("expected a message for the routes N and KT, got %+v", shuttle)
+	}
+	expected := []MessageStop{{"N", "6997", "Embarcadero Station Inbound"}, {"KT", "6997", "Embarcadero Station Inbound"}}
+	if len(shuttle.Stops) != len(expected) || shuttle.Stops[0] != expected[0] || shuttle.Stops[1] != expected[1] {
+		t.Errorf("expected the stops %+v once, got %+v", expected, shuttle.Stops)
+	}
+	if shuttle.Start != 1476680400000 || shuttle.End != 1476766800000 {
+		t.Errorf("expected the boundaries of the message, got %+v", shuttle)
+	}
+}
+
+func TestMessagesOfARoute(t *testing.T) {
+	nb := newTestNextBus(loadTestFixtures(t))
+	for routeTag, ids := range map[string][]string{"": {"21438", "21502"}, "N": {"21438", "21502"}, "38": {"21438"}} {
+		messages, err := nb.GetMessages("sf-muni", routeTag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != len(ids) {
+			t.Errorf("expected the messages %v for route <%v>, got %+v", ids, routeTag, messages)
+			continue
+		}
+		for i, message := range messages {
+			if message.Id != ids[i] {
+				t.Errorf("expected the messages %v for route <%v>, got %+v", ids, routeTag, messages)
+				break
+			}
+		}
+	}
+}
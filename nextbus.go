@@ -1,45 +1,177 @@
 package main
 
 import "github.com/geraz69/nextbus"
-import "strconv"
+import "encoding/json"
+import "reflect"
+import "sync"
+import "time"
 import "log"
 
 type NextBus struct {
 	Cacher
+	upstream    Upstream
+	ttlVehicles time.Duration
+	timezones   Timezones
+	tolerance   time.Duration
+	refreshing  *sync.Map
+	stopIndexes *sync.Map
 }
 
-type RoutesAvailability struct {
-	Running    []nextbus.Route
-	NotRunning []nextbus.Route
-	Unknown    []nextbus.Route
+// Unavailable is the negative cache entry stored when NextBus fails or returns null for a command,
+// i.e. when the data transfer rate limit is reached or the response is malformed.
+type Unavailable struct {
+	Status string
+	Reason string
+	Since  time.Time
 }
 
-type SchedulesRange struct {
-	start int
-	end   int
+func (unavailable Unavailable) Error() string {
+	return unavailable.Status + ": " + unavailable.Reason
 }
 
-func (nb NextBus) GetAgencies() ([]nextbus.Agency, error) {
-	cacheValueKey := "agencies"
+func NewNextBus(cache Cacher, upstream Upstream, ttlVehicles time.Duration, timezones Timezones, tolerance time.Duration) NextBus {
+	return NextBus{cache, upstream, ttlVehicles, timezones, tolerance, &sync.Map{}, &sync.Map{}}
+}
+
+// cached implements the cache-aside access to the NextBus feed. Fresh values are returned right away,
+// stale values are returned as well but a single background refresh is triggered for them,
+// only missing values block on the lock and the upstream call.
+func (nb NextBus) cached(cacheValueKey string, value interface{}, fetch func() (interface{}, error)) error {
+	return nb.cachedFor(cacheValueKey, 0, value, fetch)
+}
+
+// cachedFor is like cached but values are fresh for the given ttl instead of ttlData.
+func (nb NextBus) cachedFor(cacheValueKey string, ttl time.Duration, value interface{}, fetch func() (interface{}, error)) error {
+	return nb.cachedThen(cacheValueKey, ttl, value, fetch, nil)
+}
+
+// cachedThen is like cachedFor but calls stored every time a fetched value makes it into the cache,
+// including the background refreshes.
+func (nb NextBus) cachedThen(cacheValueKey string, ttl time.Duration, value interface{}, fetch func() (interface{}, error), stored func()) error {
+	found, stale, err := nb.Get(cacheValueKey, value)
+	if err != nil {
+		return err
+	}
+	if found {
+		if stale {
+			go nb.refresh(cacheValueKey, ttl, fetch, stored)
+		}
+		return nil
+	}
 	lockId, err := nb.Lock(cacheValueKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer nb.Unlock(cacheValueKey, lockId)
-	value := []nextbus.Agency{}
-	found, err := nb.Get(cacheValueKey, &value)
+	found, _, err = nb.Get(cacheValueKey, value)
+	if err != nil || found {
+		return err
+	}
+	fetched, err := nb.fetch(cacheValueKey, ttl, fetch, stored)
+	if err != nil {
+		return err
+	}
+	reflect.ValueOf(value).Elem().Set(reflect.ValueOf(fetched))
+	return nil
+}
+
+func (nb NextBus) refresh(cacheValueKey string, ttl time.Duration, fetch func() (interface{}, error), stored func()) {
+	if _, refreshing := nb.refreshing.LoadOrStore(cacheValueKey, true); refreshing {
+		return
+	}
+	defer nb.refreshing.Delete(cacheValueKey)
+	lockId, err := nb.Lock(cacheValueKey)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	defer nb.Unlock(cacheValueKey, lockId)
+	// another instance could have refreshed the value while we were waiting for the lock
+	found, stale, err := nb.Get(cacheValueKey, &json.RawMessage{})
+	if err != nil || found && !stale {
+		return
+	}
+	if _, err = nb.fetch(cacheValueKey, ttl, fetch, stored); err != nil {
+		log.Printf("Refreshing <%v> failed: %v", cacheValueKey, err.Error())
+	}
+}
+
+// fetch calls the upstream unless a negative entry says it was unavailable recently. Null responses
+// and errors are stored as negative entries so they are not retried until ttlNegative has passed.
+// stored, when not nil, is called once the fetched value is in the cache.
+func (nb NextBus) fetch(cacheValueKey string, ttl time.Duration, fetch func() (interface{}, error), stored func()) (interface{}, error) {
+	unavailable := Unavailable{}
+	found, _, err := nb.Get("unavailable:"+cacheValueKey, &unavailable)
 	if err != nil {
 		return nil, err
 	}
-	if !found {
-		log.Print("Fetching agencies")
-		value, err = nextbus.GetAgencies()
-		if err != nil {
-			return nil, err
+	if found {
+		return nil, unavailable
+	}
+	fetched, err := fetch()
+	if err == nil && !isNil(fetched) {
+		if ttl > 0 {
+			err = nb.SetFor(cacheValueKey, fetched, ttl)
+		} else {
+			err = nb.Set(cacheValueKey, fetched)
 		}
-		if value != nil {
-			nb.Set(cacheValueKey, value)
+		if err != nil {
+			log.Printf("Caching <%v> failed: %v", cacheValueKey, err.Error())
+		} else if stored != nil {
+			stored()
 		}
+		return fetched, nil
+	}
+	return nil, nb.setUnavailable(cacheValueKey, err)
+}
+
+func (nb NextBus) setUnavailable(cacheValueKey string, err error) Unavailable {
+	unavailable := Unavailable{"upstream unavailable", "null response", time.Now()}
+	if err != nil {
+		unavailable.Reason = err.Error()
+	}
+	if err = nb.SetNegative("unavailable:"+cacheValueKey, unavailable); err != nil {
+		log.Print(err.Error())
+	}
+	return unavailable
+}
+
+// claim tells whether nobody claimed the key during the last interval, claiming it if so. Lets a single
+// instance do some periodic work while the rest skip it.
+func (nb NextBus) claim(key string, interval time.Duration) (bool, error) {
+	lockId, err := nb.Lock(key)
+	if err != nil {
+		return false, err
+	}
+	defer nb.Unlock(key, lockId)
+	claimed := int64(0)
+	found, stale, err := nb.Get(key, &claimed)
+	if err != nil || found && !stale {
+		return false, err
+	}
+	return true, nb.SetFor(key, time.Now().Unix(), interval)
+}
+
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func (nb NextBus) GetAgencies() ([]nextbus.Agency, error) {
+	value := []nextbus.Agency{}
+	err := nb.cached("agencies", &value, func() (interface{}, error) {
+		log.Print("Fetching agencies")
+		return nb.upstream.GetAgencies()
+	})
+	if err != nil {
+		return nil, err
 	}
 	return value, nil
 }
@@ -55,27 +187,14 @@ func (nb NextBus) GetAgency(agencyTag string) (*nextbus.Agency, error) {
 }
 
 func (nb NextBus) GetRoutes(agencyTag string) ([]nextbus.Route, error) {
-	cacheValueKey := "agencies/" + agencyTag + "/routes"
-	lockId, err := nb.Lock(cacheValueKey)
-	if err != nil {
-		return nil, err
-	}
-	defer nb.Unlock(cacheValueKey, lockId)
 	value := []nextbus.Route{}
-	found, err := nb.Get(cacheValueKey, &value)
+	err := nb.cached("agencies/"+agencyTag+"/routes", &value, func() (interface{}, error) {
+		log.Printf("Fetching routes for agency: %v", agencyTag)
+		return nb.upstream.GetRoutes(agencyTag)
+	})
 	if err != nil {
 		return nil, err
 	}
-	if !found {
-		log.Printf("Fetching routes for agency: %v", agencyTag)
-		value, err = nextbus.GetRoutes(agencyTag)
-		if err != nil {
-			return nil, err
-		}
-		if value != nil {
-			nb.Set(cacheValueKey, value)
-		}
-	}
 	return value, nil
 }
 
@@ -89,29 +208,30 @@ func (nb NextBus) GetRoute(agencyTag, routeTag string) (*nextbus.Route, error) {
 	return nil, err
 }
 
-func (nb NextBus) GetStops(agencyTag, routeTag string) ([]nextbus.Stop, error) {
-	cacheValueKey := "agencies/" + agencyTag + "/routes/" + routeTag + "/config"
-	lockId, err := nb.Lock(cacheValueKey)
+func (nb NextBus) GetRouteConfig(agencyTag, routeTag string) (*nextbus.RouteConfig, error) {
+	value := &nextbus.RouteConfig{}
+	err := nb.cachedThen("agencies/"+agencyTag+"/routes/"+routeTag+"/config", 0, &value, func() (interface{}, error) {
+		log.Printf("Fetching stops for agency/route: %v/%v", agencyTag, routeTag)
+		config, err := nb.upstream.GetRouteConfig(agencyTag, routeTag)
+		if err != nil || len(config.Stop) == 0 {
+			return nil, err
+		}
+		return &config, nil
+	}, func() {
+		nb.touchStopIndex(agencyTag)
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer nb.Unlock(cacheValueKey, lockId)
-	value := &nextbus.RouteConfig{}
-	found, err := nb.Get(cacheValueKey, &value)
+	return value, nil
+}
+
+func (nb NextBus) GetStops(agencyTag, routeTag string) ([]nextbus.Stop, error) {
+	config, err := nb.GetRouteConfig(agencyTag, routeTag)
 	if err != nil {
 		return nil, err
 	}
-	if !found {
-		log.Printf("Fetching stops for agency/route: %v/%v", agencyTag, routeTag)
-		*value, err = nextbus.GetRouteConfig(agencyTag, routeTag, true, true)
-		if err != nil {
-			return nil, err
-		}
-		if value != nil {
-			nb.Set(cacheValueKey, value)
-		}
-	}
-	return value.Stop, nil
+	return config.Stop, nil
 }
 
 func (nb NextBus) GetStop(agencyTag, routeTag, stopTag string) (*nextbus.Stop, error) {
@@ -124,113 +244,14 @@ func (nb NextBus) GetStop(agencyTag, routeTag, stopTag string) (*nextbus.Stop, e
 	return nil, err
 }
 
-func (nb NextBus) GetPredictions(agencyTag, routeTag, stopTag string) ([]nextbus.Prediction, error) {
-	cacheValueKey := "agencies/" + agencyTag + "/routes/" + routeTag + "/stops/" + stopTag + "/predictions"
-	lockId, err := nb.Lock(cacheValueKey)
-	if err != nil {
-		return nil, err
-	}
-	defer nb.Unlock(cacheValueKey, lockId)
-	value := &nextbus.Predictions{}
-	found, err := nb.Get(cacheValueKey, &value)
-	if err != nil {
-		return nil, err
-	}
-	if !found {
-		log.Printf("Fetching predictions for agency/route/stop: %v/%v/%v", agencyTag, routeTag, stopTag)
-		*value, err = nextbus.GetPredictions(agencyTag, routeTag, stopTag)
-		if err != nil {
-			return nil, err
-		}
-		if value != nil {
-			nb.Set(cacheValueKey, value)
-		}
-	}
-	direction := value.Direction
-	return direction.Prediction, nil
-}
-
 func (nb NextBus) GetSchedules(agencyTag, routeTag string) ([]nextbus.Schedule, error) {
-	cacheValueKey := "agencies/" + agencyTag + "/routes/" + routeTag + "/schedules"
-	lockId, err := nb.Lock(cacheValueKey)
-	if err != nil {
-		return nil, err
-	}
-	defer nb.Unlock(cacheValueKey, lockId)
 	value := []nextbus.Schedule{}
-	found, err := nb.Get(cacheValueKey, &value)
-	if err != nil {
-		return nil, err
-	}
-	if !found {
+	err := nb.cached("agencies/"+agencyTag+"/routes/"+routeTag+"/schedules", &value, func() (interface{}, error) {
 		log.Printf("Fetching schedules for agency/route: %v/%v", agencyTag, routeTag)
-		value, err = nextbus.GetSchedules(agencyTag, routeTag)
-		if err != nil {
-			return nil, err
-		}
-		if value != nil {
-			nb.Set(cacheValueKey, value)
-		}
-	}
-	return value, nil
-}
-
-func (nb NextBus) GetSchedulesRange(agencyTag, routeTag string) (*SchedulesRange, error) {
-	// TODO: delimit the schedules to compare using Schedule.ServiceClass and Schedule.Direction
-	// i.e. sat:Inbound
-	start, end := 1<<63-1, -1<<63 //max and min ints
-	schedules, err := nb.GetSchedules(agencyTag, routeTag)
-	if err != nil {
-		return nil, err
-	}
-	for _, schedule := range schedules {
-		for _, tr := range schedule.Tr {
-			for _, stop := range tr.Stop {
-				if stop.Content != "--" {
-					epoch, err := strconv.Atoi(stop.EpochTime)
-					if err != nil {
-						return nil, err
-					}
-					if start > epoch {
-						start = epoch
-					}
-					if epoch > end {
-						end = epoch
-					}
-				}
-			}
-		}
-	}
-	if start > end {
-		return nil, nil
-	}
-	return &SchedulesRange{start, end}, nil
-}
-
-func (nb NextBus) GetRoutesAvailability(agencyTag string, time int) (*RoutesAvailability, error) {
-	// timeNextDay is the same time pluse the number of seconds in a day.
-	// is used to determine if the route is running when the range overlaps more than one day.
-	timeNextDay := time + 24*60*60*1000
-	routes, err := nb.GetRoutes(agencyTag)
+		return nb.upstream.GetSchedules(agencyTag, routeTag)
+	})
 	if err != nil {
 		return nil, err
 	}
-	running := []nextbus.Route{}
-	notRunning := []nextbus.Route{}
-	unavailableData := []nextbus.Route{}
-	for _, route := range routes {
-		schedulesRange, err := nb.GetSchedulesRange(agencyTag, route.Tag)
-		if err != nil || schedulesRange == nil {
-			log.Printf("Schedules for route <%v> either failed or returned an empty result", route.Tag)
-			unavailableData = append(unavailableData, route)
-		} else {
-			if time >= schedulesRange.start && time <= schedulesRange.end ||
-				timeNextDay >= schedulesRange.start && timeNextDay <= schedulesRange.end {
-				running = append(running, route)
-			} else {
-				notRunning = append(notRunning, route)
-			}
-		}
-	}
-	return &RoutesAvailability{running, notRunning, unavailableData}, nil
+	return value, nil
 }
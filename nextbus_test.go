@@ -0,0 +1,41 @@
+package main
+
+import "sync/atomic"
+import "testing"
+import "time"
+
+// countingUpstream counts the requests for predictions made to the memory upstream.
+type countingUpstream struct {
+	MemoryUpstream
+	predictions *int32
+}
+
+func (upstream countingUpstream) GetPredictions(agencyTag, routeTag, stopTag string) (*StopPredictions, error) {
+	atomic.AddInt32(upstream.predictions, 1)
+	return upstream.MemoryUpstream.GetPredictions(agencyTag, routeTag, stopTag)
+}
+
+func (upstream countingUpstream) GetMultiStopPredictions(agencyTag string, stops []PredictedStop) (map[PredictedStop]*StopPredictions, error) {
+	atomic.AddInt32(upstream.predictions, 1)
+	return upstream.MemoryUpstream.GetMultiStopPredictions(agencyTag, stops)
+}
+
+// newTestNextBus serves an upstream thru an in-process cache, with the agencies in UTC.
+func newTestNextBus(upstream Upstream) NextBus {
+	return newTestNextBusFor(upstream, time.Minute, time.Hour)
+}
+
+// newTestNextBusFor is like newTestNextBus but with the given ttlData and ttlHard.
+func newTestNextBusFor(upstream Upstream, ttlData, ttlHard time.Duration) NextBus {
+	cache := NewInProcessCache(100, ttlData, ttlHard, time.Minute, time.Second)
+	return NewNextBus(cache, upstream, time.Second, NewTimezones(time.UTC, nil), 5*time.Minute)
+}
+
+// loadTestFixtures reads the fixtures of the memory upstream.
+func loadTestFixtures(t *testing.T) MemoryUpstream {
+	memory, err := LoadMemoryUpstream("fixtures/memory.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return memory
+}
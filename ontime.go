@@ -0,0 +1,291 @@
+package main
+
+import "strings"
+import "errors"
+import "sort"
+import "time"
+import "log"
+
+// Arrivals up to onTimeEarly before and onTimeLate after the scheduled time are on time.
+const onTimeEarly = time.Minute
+const onTimeLate = 5 * time.Minute
+
+// onTimeMatchWindow is how far from the scheduled time an arrival is still matched to a trip.
+const onTimeMatchWindow = 30 * time.Minute
+
+type OnTimeRecorder struct {
+	NextBus
+	routes    []RecordedRoute
+	interval  time.Duration
+	retention time.Duration
+}
+
+type RecordedRoute struct {
+	Agency string
+	Route  string
+}
+
+// OnTimeArrival is an observed arrival at a timepoint of the schedules matched to a scheduled trip,
+// the Deviation is in seconds (positive when late) and the Status either early, ontime or late.
+type OnTimeArrival struct {
+	Direction string
+	Stop      string
+	Vehicle   string
+	BlockID   string
+	Scheduled time.Time
+	Arrived   time.Time
+	Deviation float64
+	Status    string
+	// ServiceDate is the date of the schedule of the trip, the day before Scheduled past midnight
+	ServiceDate time.Time
+}
+
+// OnTimePerformance counts the arrivals by status, the percentages are of all the arrivals.
+type OnTimePerformance struct {
+	Arrivals      int
+	Early         int
+	OnTime        int
+	Late          int
+	EarlyPercent  float64
+	OnTimePercent float64
+	LatePercent   float64
+}
+
+// OnTimeReport has the performance of a route during a date, as a whole, per direction
+// and per hour of the scheduled times.
+type OnTimeReport struct {
+	Route string
+	Date  string
+	OnTimePerformance
+	Directions []DirectionOnTime
+}
+
+type DirectionOnTime struct {
+	Direction string
+	OnTimePerformance
+	Hours []HourOnTime
+}
+
+type HourOnTime struct {
+	Hour int
+	OnTimePerformance
+}
+
+// ParseRecordedRoutes reads routes in the agency/route form.
+func ParseRecordedRoutes(routes []string) ([]RecordedRoute, error) {
+	recorded := []RecordedRoute{}
+	for _, route := range routes {
+		tags := strings.Split(route, "/")
+		if len(tags) != 2 || tags[0] == "" || tags[1] == "" {
+			return nil, errors.New("routes should be agency/route: " + route)
+		}
+		recorded = append(recorded, RecordedRoute{tags[0], tags[1]})
+	}
+	return recorded, nil
+}
+
+func NewOnTimeRecorder(nextBus NextBus, routes []RecordedRoute, interval, retention time.Duration) OnTimeRecorder {
+	return OnTimeRecorder{nextBus, routes, interval, retention}
+}
+
+func onTimeKey(agencyTag, routeTag string, date time.Time) string {
+	return "ontime/" + agencyTag + "/" + routeTag + "/" + date.Format("2006-01-02")
+}
+
+// Record watches the arrivals at the timepoints of the routes every interval until the program exits.
+func (recorder OnTimeRecorder) Record() {
+	if len(recorder.routes) == 0 {
+		return
+	}
+	for range time.Tick(recorder.interval) {
+		if claimed, err := recorder.claim("ontime/recorded", recorder.interval); err != nil || !claimed {
+			if err != nil {
+				log.Printf("Recording arrivals failed: %v", err.Error())
+			}
+			continue
+		}
+		for _, route := range recorder.routes {
+			if err := recorder.record(route); err != nil {
+				log.Printf("Recording arrivals of %v/%v failed: %v", route.Agency, route.Route, err.Error())
+			}
+		}
+	}
+}
+
+// record detects the arrivals at the stops listed in the headers of the schedules of a route (the
+// timepoints, the only stops with scheduled times) and stores them matched to their scheduled trips.
+func (recorder OnTimeRecorder) record(route RecordedRoute) error {
+	schedules, err := recorder.GetSchedules(route.Agency, route.Route)
+	if err != nil {
+		return err
+	}
+	directions, err := recorder.GetDirections(route.Agency, route.Route)
+	if err != nil {
+		return err
+	}
+	names := map[string]string{}
+	for _, direction := range directions {
+		names[direction.Tag] = direction.Name
+	}
+	timepoints := map[string]bool{}
+	stops := []PredictedStop{}
+	for _, schedule := range schedules {
+		for _, stop := range schedule.Header.Stop {
+			if !timepoints[stop.Tag] {
+				timepoints[stop.Tag] = true
+				stops = append(stops, PredictedStop{route.Route, stop.Tag})
+			}
+		}
+	}
+	if len(stops) == 0 {
+		return nil
+	}
+	// the predictions of all the timepoints in a single request
+	results, err := recorder.GetMultiStopPredictions(route.Agency, stops)
+	if err != nil {
+		return err
+	}
+	location := recorder.timezones.Location(route.Agency)
+	for _, result := range results {
+		stopTag, stop := result.StopTag, PredictedStop{result.RouteTag, result.StopTag}
+		if result.Predictions == nil {
+			log.Printf("Predictions of %v/%v/%v unavailable: %v", route.Agency, route.Route, stopTag, result.Unavailable)
+			continue
+		}
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		arrived, err := recorder.trackArrivals("ontime/"+predictionsKey(route.Agency, stop), result.Predictions, now)
+		if err != nil {
+			return err
+		}
+		for _, observations := range arrived {
+			at := time.Unix(0, now*int64(time.Millisecond)).In(location)
+			arrival, err := recorder.match(route, stopTag, names[observations.DirTag], observations, at)
+			if err != nil {
+				return err
+			}
+			if arrival == nil {
+				continue
+			}
+			if err := recorder.store(route, *arrival); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// match finds the scheduled departure of the arrival, the closest one of its block or, when the vehicle
+// doesn't report a block, the closest one of its direction.
+func (recorder OnTimeRecorder) match(route RecordedRoute, stopTag, direction string, observations trackedArrival, at time.Time) (*OnTimeArrival, error) {
+	if direction == "" {
+		return nil, nil
+	}
+	scheduled, err := recorder.GetScheduledDepartures(route.Agency, route.Route, stopTag, direction, at.Add(-onTimeMatchWindow), 1000)
+	if err != nil {
+		return nil, err
+	}
+	closest := -1
+	for i, departure := range scheduled {
+		if observations.Block != "" && departure.BlockID != observations.Block {
+			continue
+		}
+		if gap := absDuration(at.Sub(departure.Time)); gap <= onTimeMatchWindow &&
+			(closest < 0 || gap < absDuration(at.Sub(scheduled[closest].Time))) {
+			closest = i
+		}
+	}
+	if closest < 0 {
+		return nil, nil
+	}
+	deviation := at.Sub(scheduled[closest].Time)
+	status := "ontime"
+	switch {
+	case deviation < -onTimeEarly:
+		status = "early"
+	case deviation > onTimeLate:
+		status = "late"
+	}
+	return &OnTimeArrival{direction, stopTag, observations.Vehicle, scheduled[closest].BlockID,
+		scheduled[closest].Time, at, deviation.Seconds(), status, scheduled[closest].ServiceDate}, nil
+}
+
+// store adds an arrival to the ones of the service date of its trip, unless its trip was
+// already matched to another arrival at the stop.
+func (recorder OnTimeRecorder) store(route RecordedRoute, arrival OnTimeArrival) error {
+	cacheValueKey := onTimeKey(route.Agency, route.Route, arrival.ServiceDate)
+	lockId, err := recorder.Lock(cacheValueKey)
+	if err != nil {
+		return err
+	}
+	defer recorder.Unlock(cacheValueKey, lockId)
+	stored := []OnTimeArrival{}
+	if _, _, err = recorder.Get(cacheValueKey, &stored); err != nil {
+		return err
+	}
+	for _, previous := range stored {
+		if previous.Stop == arrival.Stop && previous.Direction == arrival.Direction && previous.Scheduled.Equal(arrival.Scheduled) {
+			return nil
+		}
+	}
+	return recorder.SetFor(cacheValueKey, append(stored, arrival), recorder.retention)
+}
+
+// GetOnTimeReport returns the performance of a route during a date in the agency timezone.
+func (recorder OnTimeRecorder) GetOnTimeReport(agencyTag, routeTag string, date time.Time) (*OnTimeReport, error) {
+	arrivals := []OnTimeArrival{}
+	if _, _, err := recorder.Get(onTimeKey(agencyTag, routeTag, date), &arrivals); err != nil {
+		return nil, err
+	}
+	report := &OnTimeReport{routeTag, date.Format("2006-01-02"), performance(arrivals), []DirectionOnTime{}}
+	byDirection := map[string][]OnTimeArrival{}
+	for _, arrival := range arrivals {
+		byDirection[arrival.Direction] = append(byDirection[arrival.Direction], arrival)
+	}
+	for direction, directionArrivals := range byDirection {
+		byHour := map[int][]OnTimeArrival{}
+		for _, arrival := range directionArrivals {
+			byHour[arrival.Scheduled.Hour()] = append(byHour[arrival.Scheduled.Hour()], arrival)
+		}
+		hours := []HourOnTime{}
+		for hour, hourArrivals := range byHour {
+			hours = append(hours, HourOnTime{hour, performance(hourArrivals)})
+		}
+		sort.Sort(byHourOnTime(hours))
+		report.Directions = append(report.Directions, DirectionOnTime{direction, performance(directionArrivals), hours})
+	}
+	sort.Sort(byDirectionOnTime(report.Directions))
+	return report, nil
+}
+
+func performance(arrivals []OnTimeArrival) OnTimePerformance {
+	result := OnTimePerformance{Arrivals: len(arrivals)}
+	for _, arrival := range arrivals {
+		switch arrival.Status {
+		case "early":
+			result.Early++
+		case "late":
+			result.Late++
+		default:
+			result.OnTime++
+		}
+	}
+	if result.Arrivals > 0 {
+		total := float64(result.Arrivals)
+		result.EarlyPercent = 100 * float64(result.Early) / total
+		result.OnTimePercent = 100 * float64(result.OnTime) / total
+		result.LatePercent = 100 * float64(result.Late) / total
+	}
+	return result
+}
+
+type byHourOnTime []HourOnTime
+
+func (hours byHourOnTime) Len() int           { return len(hours) }
+func (hours byHourOnTime) Swap(i, j int)      { hours[i], hours[j] = hours[j], hours[i] }
+func (hours byHourOnTime) Less(i, j int) bool { return hours[i].Hour < hours[j].Hour }
+
+type byDirectionOnTime []DirectionOnTime
+
+func (directions byDirectionOnTime) Len() int           { return len(directions) }
+func (directions byDirectionOnTime) Swap(i, j int)      { directions[i], directions[j] = directions[j], directions[i] }
+func (directions byDirectionOnTime) Less(i, j int) bool { return directions[i].Direction < directions[j].Direction }
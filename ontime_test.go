@@ -0,0 +1,54 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "sync/atomic"
+import "testing"
+import "time"
+
+func TestOnTimeArrivalsPastMidnightCountForTheirServiceDate(t *testing.T) {
+	recorder := NewOnTimeRecorder(newAvailabilityNextBus("wkd"), nil, 30*time.Second, time.Hour)
+	route := RecordedRoute{"sf-muni", "N"}
+	wednesday := time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+	// the trip of block 3 is scheduled at 25:00 on wednesday, it arrives 3 minutes late on thursday
+	at := wednesday.Add(25*time.Hour + 3*time.Minute)
+	arrival, err := recorder.match(route, "2", "Inbound", trackedArrival{Vehicle: "v1", Block: "3"}, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrival == nil || !arrival.ServiceDate.Equal(wednesday) || arrival.Status != "ontime" {
+		t.Fatalf("expected an on time arrival of wednesday, got %+v", arrival)
+	}
+	if err = recorder.store(route, *arrival); err != nil {
+		t.Fatal(err)
+	}
+	for date, arrivals := range map[time.Time]int{wednesday: 1, wednesday.AddDate(0, 0, 1): 0} {
+		report, err := recorder.GetOnTimeReport("sf-muni", "N", date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Arrivals != arrivals {
+			t.Errorf("expected %v arrivals on %v, got %+v", arrivals, report.Date, report)
+		}
+	}
+}
+
+func TestOnTimeRecordRequestsTheTimepointsOfARouteAtOnce(t *testing.T) {
+	memory := NewMemoryUpstream()
+	memory.Schedules["sf-muni/N"] = []nextbus.Schedule{
+		{ServiceClass: "wkd", Direction: "Inbound", Header: nextbus.Header{Stop: []nextbus.HeaderStop{{Tag: "0"}, {Tag: "2"}}}},
+		{ServiceClass: "wkd", Direction: "Outbound", Header: nextbus.Header{Stop: []nextbus.HeaderStop{{Tag: "2"}, {Tag: "0"}}}},
+	}
+	memory.RouteConfigs["sf-muni/N"] = nextbus.RouteConfig{Tag: "N", Stop: []nextbus.Stop{{Tag: "0"}, {Tag: "2"}}, Direction: []nextbus.Direction{
+		{Tag: "N_I", Name: "Inbound", Stop: []nextbus.DirectionStop{{Tag: "0"}, {Tag: "2"}}},
+		{Tag: "N_O", Name: "Outbound", Stop: []nextbus.DirectionStop{{Tag: "2"}, {Tag: "0"}}},
+	}}
+	memory.Predictions["sf-muni/N/0"] = &StopPredictions{RouteTag: "N", StopTag: "0"}
+	calls := new(int32)
+	recorder := NewOnTimeRecorder(newTestNextBus(countingUpstream{memory, calls}), nil, 30*time.Second, time.Hour)
+	if err := recorder.record(RecordedRoute{"sf-muni", "N"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("expected a single request for the predictions of the timepoints, got %v", n)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "strconv"
+import "sort"
+import "time"
+import "log"
+
+// plannerTransferRadius is how far (in meters) from the stop where the first leg is left the second
+// one can be boarded, walking at plannerWalkingSpeed (in meters per second).
+const plannerTransferRadius = 250.0
+const plannerWalkingSpeed = 1.2
+
+// plannerTransferTime is the least time between the legs of a trip, besides the walk.
+const plannerTransferTime = 2 * time.Minute
+
+// plannerRealtimeWindow is how close to now a departure time has to be for the predictions to be used.
+const plannerRealtimeWindow = time.Hour
+
+type TripPlan struct {
+	From        string
+	FromTitle   string
+	To          string
+	ToTitle     string
+	Time        time.Time
+	Itineraries []Itinerary
+}
+
+type Itinerary struct {
+	Departure time.Time
+	Arrival   time.Time
+	Transfers int
+	Legs      []TripLeg
+}
+
+// TripLeg is a ride on a route between two stops, Walk is the distance in meters walked to the boarding
+// stop from the previous leg. The times of the stops between timepoints are estimated from the distance
+// along the route, and Realtime legs board at the time of the prediction of their Vehicle.
+type TripLeg struct {
+	RouteTag        string
+	RouteTitle      string
+	Direction       string
+	DirectionTitle  string
+	BoardStop       string
+	BoardStopTitle  string
+	BoardTime       time.Time
+	AlightStop      string
+	AlightStopTitle string
+	AlightTime      time.Time
+	Stops           int
+	Walk            float64
+	Realtime        bool
+	Vehicle         string
+	BlockID         string
+}
+
+// plannedLeg is a ride between the stops at the board and alight positions of a direction.
+type plannedLeg struct {
+	routeTag  string
+	direction RouteDirection
+	board     int
+	alight    int
+	walk      float64
+}
+
+// plannedTrip has the times of a scheduled trip at the stops of a direction, nil where it doesn't stop.
+type plannedTrip struct {
+	blockID string
+	times   []*time.Time
+}
+
+// PlanTrip finds the trips leaving a stop after a time that reach another stop riding a single route,
+// or two of them transferring at the same or a nearby stop, the ones arriving the earliest first.
+// Trips that leave earlier, arrive later and transfer more than another one are left out.
+func (nb NextBus) PlanTrip(agencyTag, fromTag, toTag string, at time.Time, limit int) (*TripPlan, error) {
+	index, err := nb.GetStopIndex(agencyTag)
+	if err != nil {
+		return nil, err
+	}
+	from, to := index.Stop(fromTag), index.Stop(toTag)
+	if from == nil || to == nil {
+		return nil, nil
+	}
+	routes, err := nb.GetRoutes(agencyTag)
+	if err != nil {
+		return nil, err
+	}
+	titles := map[string]string{}
+	for _, route := range routes {
+		titles[route.Tag] = route.Title
+	}
+	planner := tripPlanner{nb, agencyTag, index, at, map[string][]RouteDirection{}, map[string][]plannedTrip{}}
+	candidates := [][]plannedLeg{}
+	transfers := map[[2]string]bool{}
+	for _, first := range planner.legsFrom(fromTag) {
+		stops := first.direction.Stops
+		if alight := indexOfStop(stops, toTag, first.board+1); alight >= 0 {
+			first.alight = alight
+			candidates = append(candidates, []plannedLeg{first})
+			continue
+		}
+		// transfers to every other direction at the first stop they get close enough, the stops
+		// without a valid location in the index can't be transferred at
+		for k := first.board + 1; k < len(stops); k++ {
+			i, ok := index.tags[stops[k].Tag]
+			if !ok {
+				continue
+			}
+			position := index.positions[i]
+			for _, nearby := range index.Nearby(position.lat, position.lon, plannerTransferRadius) {
+				for _, second := range planner.legsFrom(nearby.Tag) {
+					pair := [2]string{first.direction.Tag, second.direction.Tag}
+					if second.routeTag == first.routeTag || transfers[pair] {
+						continue
+					}
+					if alight := indexOfStop(second.direction.Stops, toTag, second.board+1); alight >= 0 {
+						transfers[pair] = true
+						leg1, leg2 := first, second
+						leg1.alight, leg2.alight, leg2.walk = k, alight, nearby.Distance
+						candidates = append(candidates, []plannedLeg{leg1, leg2})
+					}
+				}
+			}
+		}
+	}
+	itineraries := []Itinerary{}
+	for _, legs := range candidates {
+		itinerary, err := planner.itinerary(legs, titles)
+		if err != nil {
+			return nil, err
+		}
+		if itinerary != nil {
+			itineraries = append(itineraries, *itinerary)
+		}
+	}
+	sort.Sort(byArrival(itineraries))
+	plan := &TripPlan{from.Tag, from.Title, to.Tag, to.Title, at, []Itinerary{}}
+	for _, itinerary := range itineraries {
+		dominated := false
+		for _, kept := range plan.Itineraries {
+			if kept.Transfers <= itinerary.Transfers && !kept.Departure.Before(itinerary.Departure) {
+				dominated = true
+				break
+			}
+		}
+		if !dominated && len(plan.Itineraries) < limit {
+			plan.Itineraries = append(plan.Itineraries, itinerary)
+		}
+	}
+	return plan, nil
+}
+
+type tripPlanner struct {
+	NextBus
+	agencyTag  string
+	index      *StopIndex
+	at         time.Time
+	directions map[string][]RouteDirection
+	trips      map[string][]plannedTrip
+}
+
+// legsFrom returns a leg for every direction of the routes that serve a stop, boarding there.
+func (planner tripPlanner) legsFrom(stopTag string) []plannedLeg {
+	legs := []plannedLeg{}
+	stop := planner.index.Stop(stopTag)
+	if stop == nil {
+		return legs
+	}
+	for _, routeTag := range stop.Routes {
+		directions, ok := planner.directions[routeTag]
+		if !ok {
+			var err error
+			if directions, err = planner.GetDirections(planner.agencyTag, routeTag); err != nil {
+				log.Printf("Planning trips without route <%v>: %v", routeTag, err.Error())
+			}
+			planner.directions[routeTag] = directions
+		}
+		for _, direction := range directions {
+			if board := indexOfStop(direction.Stops, stopTag, 0); board >= 0 {
+				legs = append(legs, plannedLeg{routeTag, direction, board, -1, 0})
+			}
+		}
+	}
+	return legs
+}
+
+// itinerary takes the earliest trip of every leg, the first one from the predictions when the time
+// of the plan is close to now. It's nil if some leg can't be made.
+func (planner tripPlanner) itinerary(legs []plannedLeg, titles map[string]string) (*Itinerary, error) {
+	itinerary := &Itinerary{Transfers: len(legs) - 1, Legs: []TripLeg{}}
+	after := planner.at
+	for i, leg := range legs {
+		trips, err := planner.directionTrips(leg.routeTag, leg.direction)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			after = after.Add(plannerTransferTime + time.Duration(leg.walk/plannerWalkingSpeed)*time.Second)
+		}
+		stops := leg.direction.Stops
+		tripLeg := TripLeg{leg.routeTag, titles[leg.routeTag], leg.direction.Tag, leg.direction.Title,
+			stops[leg.board].Tag, stops[leg.board].Title, time.Time{}, stops[leg.alight].Tag, stops[leg.alight].Title,
+			time.Time{}, leg.alight - leg.board, leg.walk, false, "", ""}
+		found := false
+		if i == 0 && absDuration(planner.at.Sub(time.Now())) <= plannerRealtimeWindow {
+			found = planner.predictedLeg(&tripLeg, leg, trips)
+		}
+		if !found {
+			for _, trip := range trips {
+				board, alight := trip.times[leg.board], trip.times[leg.alight]
+				if board != nil && alight != nil && !board.Before(after) && !alight.Before(*board) &&
+					(!found || board.Before(tripLeg.BoardTime)) {
+					tripLeg.BoardTime, tripLeg.AlightTime, tripLeg.BlockID, found = *board, *alight, trip.blockID, true
+				}
+			}
+		}
+		if !found {
+			return nil, nil
+		}
+		after = tripLeg.AlightTime
+		itinerary.Legs = append(itinerary.Legs, tripLeg)
+	}
+	itinerary.Departure = itinerary.Legs[0].BoardTime
+	itinerary.Arrival = itinerary.Legs[len(itinerary.Legs)-1].AlightTime
+	return itinerary, nil
+}
+
+// predictedLeg boards the first vehicle predicted at the stop of the leg after the time of the plan,
+// riding as long as the scheduled trip of its block closest to the prediction, or any closest trip.
+func (planner tripPlanner) predictedLeg(tripLeg *TripLeg, leg plannedLeg, trips []plannedTrip) bool {
+	predictions, err := planner.GetPredictions(planner.agencyTag, leg.routeTag, tripLeg.BoardStop)
+	if err != nil {
+		log.Printf("Planning trips without predictions for route <%v>: %v", leg.routeTag, err.Error())
+		return false
+	}
+	for _, prediction := range predictions.Predictions() {
+		predicted := predictionTime(prediction, planner.at.Location())
+		if prediction.DirTag != leg.direction.Tag || predicted.Before(planner.at) {
+			continue
+		}
+		closest, sameBlock := -1, false
+		for i, trip := range trips {
+			board, alight := trip.times[leg.board], trip.times[leg.alight]
+			if board == nil || alight == nil {
+				continue
+			}
+			matches := prediction.Block != "" && trip.blockID == prediction.Block &&
+				absDuration(predicted.Sub(*board)) <= boardMatchWindow
+			if closest < 0 || (matches && !sameBlock) || (matches == sameBlock &&
+				absDuration(predicted.Sub(*board)) < absDuration(predicted.Sub(*trips[closest].times[leg.board]))) {
+				closest, sameBlock = i, matches
+			}
+		}
+		if closest < 0 {
+			return false
+		}
+		ride := trips[closest].times[leg.alight].Sub(*trips[closest].times[leg.board])
+		tripLeg.BoardTime, tripLeg.AlightTime = predicted, predicted.Add(ride)
+		tripLeg.Realtime, tripLeg.Vehicle, tripLeg.BlockID = true, prediction.Vehicle, prediction.Block
+		return true
+	}
+	return false
+}
+
+// directionTrips returns the scheduled trips of a direction around the time of the plan, from the day
+// before (past midnight) to the next one.
+func (planner tripPlanner) directionTrips(routeTag string, direction RouteDirection) ([]plannedTrip, error) {
+	if trips, ok := planner.trips[direction.Tag]; ok {
+		return trips, nil
+	}
+	schedules, err := planner.GetSchedules(planner.agencyTag, routeTag)
+	if err != nil {
+		return nil, err
+	}
+	trips := []plannedTrip{}
+	date := serviceDate(planner.at)
+	for _, day := range []time.Time{date.AddDate(0, 0, -1), date, date.AddDate(0, 0, 1)} {
+		for _, schedule := range serviceSchedules(schedules, day) {
+			if schedule.Direction != direction.Name {
+				continue
+			}
+			for _, tr := range schedule.Tr {
+				trip, err := planner.interpolate(day, tr, direction)
+				if err != nil {
+					return nil, err
+				}
+				if trip != nil {
+					trips = append(trips, *trip)
+				}
+			}
+		}
+	}
+	planner.trips[direction.Tag] = trips
+	return trips, nil
+}
+
+// interpolate estimates the times of a scheduled trip at the stops of a direction between every two
+// of its timepoints, in proportion to the distance along the direction. The stops without a valid
+// location in the index are left without a time. It's nil when the trip has less than two timepoints
+// in the direction.
+func (planner tripPlanner) interpolate(day time.Time, tr nextbus.Tr, direction RouteDirection) (*plannedTrip, error) {
+	trip := &plannedTrip{tr.BlockID, make([]*time.Time, len(direction.Stops))}
+	timepoints := []int{}
+	for _, stop := range tr.Stop {
+		if stop.Content == "--" {
+			continue
+		}
+		epoch, err := strconv.Atoi(stop.EpochTime)
+		if err != nil {
+			return nil, err
+		}
+		if position := indexOfStop(direction.Stops, stop.Tag, 0); position >= 0 && trip.times[position] == nil {
+			scheduled := scheduleTime(day, epoch)
+			trip.times[position] = &scheduled
+			timepoints = append(timepoints, position)
+		}
+	}
+	if len(timepoints) < 2 {
+		return nil, nil
+	}
+	sort.Ints(timepoints)
+	along := make([]float64, len(direction.Stops))
+	located := make([]bool, len(direction.Stops))
+	var previous *stopPosition
+	for i, stop := range direction.Stops {
+		if i > 0 {
+			along[i] = along[i-1]
+		}
+		j, ok := planner.index.tags[stop.Tag]
+		if !ok {
+			continue
+		}
+		current := planner.index.positions[j]
+		if previous != nil {
+			along[i] += distance(previous.lat, previous.lon, current.lat, current.lon)
+		}
+		located[i], previous = true, &current
+	}
+	for t := 1; t < len(timepoints); t++ {
+		a, b := timepoints[t-1], timepoints[t]
+		start, end := *trip.times[a], *trip.times[b]
+		for i := a + 1; i < b; i++ {
+			if !located[i] {
+				continue
+			}
+			estimated := start
+			if along[b] > along[a] {
+				estimated = start.Add(time.Duration(float64(end.Sub(start)) * (along[i] - along[a]) / (along[b] - along[a])))
+			}
+			trip.times[i] = &estimated
+		}
+	}
+	return trip, nil
+}
+
+// indexOfStop is the first position of a stop in the stops of a direction starting at an index, or -1.
+func indexOfStop(stops []OrderedStop, stopTag string, start int) int {
+	for i := start; i < len(stops); i++ {
+		if stops[i].Tag == stopTag {
+			return i
+		}
+	}
+	return -1
+}
+
+// byArrival sorts the itineraries arriving the earliest first, then the ones with less transfers
+// and then the ones leaving the latest.
+type byArrival []Itinerary
+
+func (itineraries byArrival) Len() int { return len(itineraries) }
+func (itineraries byArrival) Swap(i, j int) {
+	itineraries[i], itineraries[j] = itineraries[j], itineraries[i]
+}
+func (itineraries byArrival) Less(i, j int) bool {
+	a, b := itineraries[i], itineraries[j]
+	if !a.Arrival.Equal(b.Arrival) {
+		return a.Arrival.Before(b.Arrival)
+	}
+	if a.Transfers != b.Transfers {
+		return a.Transfers < b.Transfers
+	}
+	return a.Departure.After(b.Departure)
+}
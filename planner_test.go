@@ -0,0 +1,147 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "strconv"
+import "testing"
+import "time"
+
+// newPlannerUpstream has the route A running east along the stops A1 to A4 and the route B running north
+// along B1 to B4, crossing it between A3 and B2 which are about 55 meters apart. The routes C and D go
+// from A1 to B4 directly.
+func newPlannerUpstream() MemoryUpstream {
+	memory := NewMemoryUpstream()
+	memory.Routes["sf-muni"] = []nextbus.Route{{Tag: "A", Title: "A"}, {Tag: "B", Title: "B"}, {Tag: "C", Title: "C"}, {Tag: "D", Title: "D"}}
+	stops := map[string]nextbus.Stop{
+		"A1": {Tag: "A1", Lat: "37.70", Lon: "-122.50"},
+		"A2": {Tag: "A2", Lat: "37.70", Lon: "-122.49"},
+		"A3": {Tag: "A3", Lat: "37.70", Lon: "-122.48"},
+		"A4": {Tag: "A4", Lat: "37.70", Lon: "-122.47"},
+		"B1": {Tag: "B1", Lat: "37.69", Lon: "-122.48"},
+		"B2": {Tag: "B2", Lat: "37.7005", Lon: "-122.48"},
+		"B3": {Tag: "B3", Lat: "37.71", Lon: "-122.48"},
+		"B4": {Tag: "B4", Lat: "37.72", Lon: "-122.48"},
+	}
+	for routeTag, tags := range map[string][]string{
+		"A": {"A1", "A2", "A3", "A4"},
+		"B": {"B1", "B2", "B3", "B4"},
+		"C": {"A1", "B4"},
+		"D": {"A1", "B4"},
+	} {
+		config := nextbus.RouteConfig{Tag: routeTag}
+		direction := nextbus.Direction{Tag: routeTag + "_O", Title: "Outbound", Name: "Outbound"}
+		for _, tag := range tags {
+			config.Stop = append(config.Stop, stops[tag])
+			direction.Stop = append(direction.Stop, nextbus.DirectionStop{Tag: tag})
+		}
+		config.Direction = []nextbus.Direction{direction}
+		memory.RouteConfigs["sf-muni/"+routeTag] = config
+	}
+	return memory
+}
+
+// plannedTr builds a trip of a block stopping at every stop of a route at the minutes after a time.
+func plannedTr(memory MemoryUpstream, routeTag, block string, at time.Time, minutes ...float64) nextbus.Tr {
+	tr := nextbus.Tr{BlockID: block}
+	for i, direction := range memory.RouteConfigs["sf-muni/"+routeTag].Direction[0].Stop {
+		scheduled := at.Add(time.Duration(minutes[i] * float64(time.Minute)))
+		epoch := int(scheduled.Sub(serviceDate(at)) / time.Millisecond)
+		tr.Stop = append(tr.Stop, nextbus.ScheduleStop{Tag: direction.Tag, EpochTime: strconv.Itoa(epoch), Content: "x"})
+	}
+	return tr
+}
+
+// scheduleTrips has the trips of a route run every day.
+func scheduleTrips(memory MemoryUpstream, routeTag string, trs ...nextbus.Tr) {
+	memory.Schedules["sf-muni/"+routeTag] = []nextbus.Schedule{{ServiceClass: "daily", Direction: "Outbound", Tr: trs}}
+}
+
+// legsOf describes the legs of an itinerary as route@board-alight in minutes after a time.
+func legsOf(itinerary Itinerary, at time.Time) string {
+	legs := ""
+	for _, leg := range itinerary.Legs {
+		legs += leg.RouteTag + "@" + strconv.FormatFloat(leg.BoardTime.Sub(at).Minutes(), 'f', -1, 64) + "-" +
+			strconv.FormatFloat(leg.AlightTime.Sub(at).Minutes(), 'f', -1, 64) + " "
+	}
+	return legs
+}
+
+func planTrip(t *testing.T, memory MemoryUpstream, from, to string, at time.Time) []string {
+	plan, err := newTestNextBus(memory).PlanTrip("sf-muni", from, to, at, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan == nil {
+		t.Fatal("expected the stops to be known")
+	}
+	itineraries := []string{}
+	for _, itinerary := range plan.Itineraries {
+		itineraries = append(itineraries, legsOf(itinerary, at))
+	}
+	return itineraries
+}
+
+func TestPlanTrip(t *testing.T) {
+	at := time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+	memory := newPlannerUpstream()
+	scheduleTrips(memory, "A", plannedTr(memory, "A", "a1", at, -5, 0, 5, 10), plannedTr(memory, "A", "a2", at, 5, 10, 15, 20))
+	// the first trip of B leaves B2 less than 2 minutes plus the walk after A gets to A3
+	scheduleTrips(memory, "B", plannedTr(memory, "B", "b1", at, 16, 17+1.0/6, 20, 25), plannedTr(memory, "B", "b2", at, 19, 20, 25, 30))
+	// C leaves later and arrives earlier than D, but after the transfer from A to B
+	scheduleTrips(memory, "C", plannedTr(memory, "C", "c1", at, 2, 45))
+	scheduleTrips(memory, "D", plannedTr(memory, "D", "d1", at, 1, 50))
+	cases := []struct {
+		name        string
+		from        string
+		to          string
+		itineraries []string
+	}{
+		{"direct", "A1", "A4", []string{"A@5-20 "}},
+		{"with a transfer", "A1", "B3", []string{"A@5-15 B@20-25 "}},
+		{"leaving out the dominated", "A1", "B4", []string{"A@5-15 B@20-30 ", "C@2-45 "}},
+	}
+	for _, c := range cases {
+		itineraries := planTrip(t, memory, c.from, c.to, at)
+		if len(itineraries) != len(c.itineraries) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.itineraries, itineraries)
+			continue
+		}
+		for i := range itineraries {
+			if itineraries[i] != c.itineraries[i] {
+				t.Errorf("%v: expected %v, got %v", c.name, c.itineraries, itineraries)
+				break
+			}
+		}
+	}
+	plan, _ := newTestNextBus(memory).PlanTrip("sf-muni", "A1", "B3", at, 10)
+	if walk := plan.Itineraries[0].Legs[1].Walk; walk < 50 || walk > 60 {
+		t.Errorf("expected a walk of about 55 meters from A3 to B2, got %v", walk)
+	}
+}
+
+func TestPlanTripBoardsThePredictedVehicle(t *testing.T) {
+	at := time.Now().UTC().Truncate(time.Minute)
+	memory := newPlannerUpstream()
+	// the prediction is closer to a1 but it belongs to the block of a2, which takes longer
+	scheduleTrips(memory, "A", plannedTr(memory, "A", "a1", at, 7, 10, 15, 20), plannedTr(memory, "A", "a2", at, 10, 15, 20, 30))
+	memory.Predictions["sf-muni/A/A1"] = &StopPredictions{RouteTag: "A", StopTag: "A1", Direction: []PredictionsDirection{{
+		Title: "Outbound",
+		Prediction: []Prediction{
+			{EpochTime: at.Add(-time.Minute).UnixNano() / int64(time.Millisecond), DirTag: "A_O", Vehicle: "v1", Block: "a0"},
+			{EpochTime: at.Add(7*time.Minute).UnixNano() / int64(time.Millisecond), DirTag: "A_O", Vehicle: "v2", Block: "a2"},
+		},
+	}}}
+	plan, err := newTestNextBus(memory).PlanTrip("sf-muni", "A1", "A4", at, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Itineraries) != 1 {
+		t.Fatalf("expected a single itinerary, got %+v", plan.Itineraries)
+	}
+	leg := plan.Itineraries[0].Legs[0]
+	if !leg.Realtime || leg.Vehicle != "v2" || leg.BlockID != "a2" {
+		t.Errorf("expected to board the vehicle predicted after the time of the plan, got %+v", leg)
+	}
+	if legs := legsOf(plan.Itineraries[0], at); legs != "A@7-27 " {
+		t.Errorf("expected to ride as long as the trip of the block, got %v", legs)
+	}
+}
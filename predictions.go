@@ -0,0 +1,275 @@
+package main
+
+import "sort"
+import "log"
+
+type PredictedStop struct {
+	RouteTag string
+	StopTag  string
+}
+
+// StopPredictions holds the predictions of every direction that goes thru a stop. When there are no
+// predictions DirTitleBecauseNoPredictions tells the direction the stop would be served by.
+type StopPredictions struct {
+	AgencyTitle                  string                 `xml:"agencyTitle,attr"`
+	RouteTag                     string                 `xml:"routeTag,attr"`
+	RouteTitle                   string                 `xml:"routeTitle,attr"`
+	StopTag                      string                 `xml:"stopTag,attr"`
+	StopTitle                    string                 `xml:"stopTitle,attr"`
+	DirTitleBecauseNoPredictions string                 `xml:"dirTitleBecauseNoPredictions,attr"`
+	Direction                    []PredictionsDirection `xml:"direction"`
+	Message                      []PredictionsMessage   `xml:"message"`
+}
+
+type PredictionsDirection struct {
+	Title      string       `xml:"title,attr"`
+	Prediction []Prediction `xml:"prediction"`
+}
+
+// Prediction has the time of arrival (or departure if IsDeparture) of a vehicle, EpochTime is in milliseconds.
+type Prediction struct {
+	EpochTime         int64  `xml:"epochTime,attr"`
+	Seconds           int    `xml:"seconds,attr"`
+	Minutes           int    `xml:"minutes,attr"`
+	IsDeparture       bool   `xml:"isDeparture,attr"`
+	AffectedByLayover bool   `xml:"affectedByLayover,attr"`
+	Block             string `xml:"block,attr"`
+	DirTag            string `xml:"dirTag,attr"`
+	TripTag           string `xml:"tripTag,attr"`
+	Vehicle           string `xml:"vehicle,attr"`
+}
+
+type PredictionsMessage struct {
+	Text     string `xml:"text,attr"`
+	Priority string `xml:"priority,attr"`
+}
+
+type MultiStopPredictions struct {
+	RouteTag    string
+	StopTag     string
+	Predictions *StopPredictions
+	Unavailable *Unavailable
+}
+
+// normalize makes sure that lists are never null in the responses, no matter if the upstream
+// skipped them or delivered a single element without wrapping it in a list.
+func (predictions *StopPredictions) normalize() *StopPredictions {
+	if predictions.Direction == nil {
+		predictions.Direction = []PredictionsDirection{}
+	}
+	for i := range predictions.Direction {
+		if predictions.Direction[i].Prediction == nil {
+			predictions.Direction[i].Prediction = []Prediction{}
+		}
+	}
+	if predictions.Message == nil {
+		predictions.Message = []PredictionsMessage{}
+	}
+	return predictions
+}
+
+// Predictions returns the predictions of all the directions sorted by time.
+func (predictions *StopPredictions) Predictions() []Prediction {
+	all := []Prediction{}
+	for _, direction := range predictions.Direction {
+		all = append(all, direction.Prediction...)
+	}
+	sort.Sort(byEpochTime(all))
+	return all
+}
+
+func predictionsKey(agencyTag string, stop PredictedStop) string {
+	return "agencies/" + agencyTag + "/routes/" + stop.RouteTag + "/stops/" + stop.StopTag + "/predictions"
+}
+
+func (nb NextBus) GetPredictions(agencyTag, routeTag, stopTag string) (*StopPredictions, error) {
+	value := &StopPredictions{}
+	stop := PredictedStop{routeTag, stopTag}
+	if err := nb.cached(predictionsKey(agencyTag, stop), &value, nb.fetchPredictions(agencyTag, stop)); err != nil {
+		return nil, err
+	}
+	return value.normalize(), nil
+}
+
+func (nb NextBus) fetchPredictions(agencyTag string, stop PredictedStop) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		log.Printf("Fetching predictions for agency/route/stop: %v/%v/%v", agencyTag, stop.RouteTag, stop.StopTag)
+		nb.trackPredictedStops(agencyTag, stop)
+		return nb.upstream.GetPredictions(agencyTag, stop.RouteTag, stop.StopTag)
+	}
+}
+
+// trackPredictedStops keeps the list of stops of an agency which predictions are being cached,
+// the list expires along with the predictions when they stop being requested.
+func (nb NextBus) trackPredictedStops(agencyTag string, predictedStops ...PredictedStop) {
+	cacheValueKey := "agencies/" + agencyTag + "/predictions"
+	lockId, err := nb.Lock(cacheValueKey)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	defer nb.Unlock(cacheValueKey, lockId)
+	stops := []PredictedStop{}
+	if _, _, err = nb.Get(cacheValueKey, &stops); err != nil {
+		log.Print(err.Error())
+		return
+	}
+	tracked := map[PredictedStop]bool{}
+	for _, stop := range stops {
+		tracked[stop] = true
+	}
+	for _, stop := range predictedStops {
+		if !tracked[stop] {
+			tracked[stop] = true
+			stops = append(stops, stop)
+		}
+	}
+	if err = nb.Set(cacheValueKey, stops); err != nil {
+		log.Print(err.Error())
+	}
+}
+
+// GetCachedPredictions returns the predictions of an agency that are currently in the cache,
+// without fetching anything from upstream.
+func (nb NextBus) GetCachedPredictions(agencyTag string) (map[PredictedStop]*StopPredictions, error) {
+	stops := []PredictedStop{}
+	if _, _, err := nb.Get("agencies/"+agencyTag+"/predictions", &stops); err != nil {
+		return nil, err
+	}
+	predictions := map[PredictedStop]*StopPredictions{}
+	for _, stop := range stops {
+		value := &StopPredictions{}
+		found, _, err := nb.Get(predictionsKey(agencyTag, stop), &value)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			predictions[stop] = value.normalize()
+		}
+	}
+	return predictions, nil
+}
+
+// GetMultiStopPredictions returns the predictions for several stops at once. Cached predictions are served
+// right away and only the missing ones are fetched, all of them in a single upstream request.
+func (nb NextBus) GetMultiStopPredictions(agencyTag string, stops []PredictedStop) ([]MultiStopPredictions, error) {
+	results := []MultiStopPredictions{}
+	misses, stales := []PredictedStop{}, []PredictedStop{}
+	// the hits are kept as read, they could be evicted or expire before the misses are fetched
+	cached := map[PredictedStop]*StopPredictions{}
+	for _, stop := range stops {
+		value := &StopPredictions{}
+		found, stale, err := nb.Get(predictionsKey(agencyTag, stop), &value)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			misses = append(misses, stop)
+			continue
+		}
+		cached[stop] = value
+		if stale {
+			stales = append(stales, stop)
+		}
+	}
+	if len(stales) > 0 {
+		go func() {
+			if _, err := nb.fetchMultiStopPredictions(agencyTag, stales, true); err != nil {
+				log.Printf("Refreshing predictions for agency <%v> failed: %v", agencyTag, err.Error())
+			}
+		}()
+	}
+	fetched, err := nb.fetchMultiStopPredictions(agencyTag, misses, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, stop := range stops {
+		result, ok := fetched[stop]
+		if !ok {
+			result = MultiStopPredictions{stop.RouteTag, stop.StopTag, cached[stop].normalize(), nil}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// fetchMultiStopPredictions takes the lock of every stop and fetches the ones that are still missing
+// (or stale when refreshing) with a single predictionsForMultiStops request, then stores them under
+// the same keys used by GetPredictions.
+func (nb NextBus) fetchMultiStopPredictions(agencyTag string, stops []PredictedStop, refreshing bool) (map[PredictedStop]MultiStopPredictions, error) {
+	results := map[PredictedStop]MultiStopPredictions{}
+	// locks are always taken in the same order to avoid deadlocks between concurrent requests
+	sorted := append([]PredictedStop{}, stops...)
+	sort.Sort(byRouteAndStop(sorted))
+	pending := []PredictedStop{}
+	for i, stop := range sorted {
+		cacheValueKey := predictionsKey(agencyTag, stop)
+		if i > 0 && stop == sorted[i-1] {
+			continue
+		}
+		if refreshing {
+			if _, loaded := nb.refreshing.LoadOrStore(cacheValueKey, true); loaded {
+				continue
+			}
+			defer nb.refreshing.Delete(cacheValueKey)
+		}
+		lockId, err := nb.Lock(cacheValueKey)
+		if err != nil {
+			return nil, err
+		}
+		defer nb.Unlock(cacheValueKey, lockId)
+		value := &StopPredictions{}
+		found, stale, err := nb.Get(cacheValueKey, &value)
+		if err != nil {
+			return nil, err
+		}
+		if found && (!stale || !refreshing) {
+			results[stop] = MultiStopPredictions{stop.RouteTag, stop.StopTag, value.normalize(), nil}
+			continue
+		}
+		unavailable := Unavailable{}
+		found, _, err = nb.Get("unavailable:"+cacheValueKey, &unavailable)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			results[stop] = MultiStopPredictions{stop.RouteTag, stop.StopTag, nil, &unavailable}
+			continue
+		}
+		pending = append(pending, stop)
+	}
+	if len(pending) == 0 {
+		return results, nil
+	}
+	log.Printf("Fetching predictions for %v stops of agency: %v", len(pending), agencyTag)
+	nb.trackPredictedStops(agencyTag, pending...)
+	fetched, err := nb.upstream.GetMultiStopPredictions(agencyTag, pending)
+	for _, stop := range pending {
+		predictions, ok := fetched[stop]
+		if err == nil && ok && predictions != nil {
+			nb.Set(predictionsKey(agencyTag, stop), predictions)
+			results[stop] = MultiStopPredictions{stop.RouteTag, stop.StopTag, predictions.normalize(), nil}
+		} else {
+			unavailable := nb.setUnavailable(predictionsKey(agencyTag, stop), err)
+			results[stop] = MultiStopPredictions{stop.RouteTag, stop.StopTag, nil, &unavailable}
+		}
+	}
+	return results, nil
+}
+
+type byRouteAndStop []PredictedStop
+
+func (stops byRouteAndStop) Len() int      { return len(stops) }
+func (stops byRouteAndStop) Swap(i, j int) { stops[i], stops[j] = stops[j], stops[i] }
+func (stops byRouteAndStop) Less(i, j int) bool {
+	if stops[i].RouteTag != stops[j].RouteTag {
+		return stops[i].RouteTag < stops[j].RouteTag
+	}
+	return stops[i].StopTag < stops[j].StopTag
+}
+
+type byEpochTime []Prediction
+
+func (predictions byEpochTime) Len() int           { return len(predictions) }
+func (predictions byEpochTime) Swap(i, j int)      { predictions[i], predictions[j] = predictions[j], predictions[i] }
+func (predictions byEpochTime) Less(i, j int) bool { return predictions[i].EpochTime < predictions[j].EpochTime }
@@ -0,0 +1,77 @@
+package main
+
+import "sync/atomic"
+import "testing"
+import "time"
+
+// forgetfulCache misses the keys of the predictions after they were read once, like entries
+// evicted or expired in between.
+type forgetfulCache struct {
+	Cacher
+	read map[string]bool
+}
+
+func (cache forgetfulCache) Get(key string, v interface{}) (bool, bool, error) {
+	if cache.read[key] {
+		return false, false, nil
+	}
+	cache.read[key] = true
+	return cache.Cacher.Get(key, v)
+}
+
+func TestMultiStopPredictions(t *testing.T) {
+	calls := new(int32)
+	nb := newTestNextBus(countingUpstream{loadTestFixtures(t), calls})
+	if _, err := nb.GetPredictions("sf-muni", "N", "5205"); err != nil {
+		t.Fatal(err)
+	}
+	stops := []PredictedStop{{"N", "5205"}, {"38", "3560"}, {"N", "missing"}}
+	results, err := nb.GetMultiStopPredictions("sf-muni", stops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("expected the hit to be served from the cache and a single request for the misses, got %v requests", n)
+	}
+	if len(results) != len(stops) {
+		t.Fatalf("expected a result per stop, got %+v", results)
+	}
+	for i, result := range results[:2] {
+		if result.RouteTag != stops[i].RouteTag || result.Predictions == nil || result.Predictions.StopTag != stops[i].StopTag {
+			t.Errorf("expected the predictions of %+v, got %+v", stops[i], result)
+		}
+	}
+	if missing := results[2]; missing.Predictions != nil || missing.Unavailable == nil {
+		t.Errorf("expected the stop without predictions to be unavailable, got %+v", missing)
+	}
+	// the response was split in the keys of every stop, including the unavailable ones
+	if predictions, err := nb.GetPredictions("sf-muni", "38", "3560"); err != nil || predictions.StopTag != "3560" {
+		t.Errorf("expected the fetched predictions in the cache, got %+v %v", predictions, err)
+	}
+	if _, err := nb.GetPredictions("sf-muni", "N", "missing"); err == nil {
+		t.Error("expected the stop without predictions to be unavailable")
+	}
+	if _, err = nb.GetMultiStopPredictions("sf-muni", stops); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("expected every stop to be served from the cache, got %v requests", n)
+	}
+}
+
+func TestMultiStopPredictionsKeepTheHitsAsRead(t *testing.T) {
+	memory := loadTestFixtures(t)
+	cache := forgetfulCache{NewInProcessCache(100, time.Minute, time.Hour, time.Minute, time.Second), map[string]bool{}}
+	nb := NewNextBus(cache, memory, time.Second, NewTimezones(time.UTC, nil), 5*time.Minute)
+	predictions, _ := memory.GetPredictions("sf-muni", "N", "5205")
+	if err := nb.Set(predictionsKey("sf-muni", PredictedStop{"N", "5205"}), predictions); err != nil {
+		t.Fatal(err)
+	}
+	results, err := nb.GetMultiStopPredictions("sf-muni", []PredictedStop{{"N", "5205"}, {"38", "3560"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit := results[0].Predictions; hit == nil || hit.StopTag != "5205" || len(hit.Direction) == 0 {
+		t.Errorf("expected the predictions read from the cache, got %+v", hit)
+	}
+}
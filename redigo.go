@@ -1,17 +1,17 @@
 package main
 
 import "github.com/garyburd/redigo/redis"
-import "encoding/json"
 import "math/rand"
+import "strconv"
 import "errors"
-import "bytes"
 import "time"
-import "fmt"
 
 type RedisCache struct {
-	url     string
-	ttlData time.Duration
-	ttlLock time.Duration
+	url         string
+	ttlData     time.Duration
+	ttlHard     time.Duration
+	ttlNegative time.Duration
+	ttlLock     time.Duration
 }
 
 type RedisCounter struct {
@@ -26,32 +26,47 @@ const unlockScript = `
 	end
 `
 
-func NewRedisCache(url string, ttlData time.Duration, ttlLock time.Duration) RedisCache {
+func NewRedisCache(url string, ttlData, ttlHard, ttlNegative, ttlLock time.Duration) RedisCache {
 	return RedisCache{
-		url:     url,
-		ttlData: ttlData,
-		ttlLock: ttlLock,
+		url:         url,
+		ttlData:     ttlData,
+		ttlHard:     ttlHard,
+		ttlNegative: ttlNegative,
+		ttlLock:     ttlLock,
 	}
 }
 
-func (cache RedisCache) Get(key string, v interface{}) (bool, error) {
+func (cache RedisCache) Get(key string, v interface{}) (bool, bool, error) {
 	conn, err := redis.Dial("tcp", cache.url)
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 	defer conn.Close()
 	b, err := redis.Bytes(conn.Do("GET", key))
 	if err != nil && err != redis.ErrNil {
-		return false, err
+		return false, false, err
 	} else if err == redis.ErrNil {
-		return false, nil
+		return false, false, nil
 	}
-	decoder := json.NewDecoder(bytes.NewReader(b))
-	err = decoder.Decode(&v)
-	return true, err
+	return decodeEntry(b, v)
 }
 
 func (cache RedisCache) Set(key string, value interface{}) error {
+	return cache.set(key, value, cache.ttlData, cache.ttlHard)
+}
+
+func (cache RedisCache) SetFor(key string, value interface{}, ttl time.Duration) error {
+	if ttl > cache.ttlHard {
+		return cache.set(key, value, ttl, ttl)
+	}
+	return cache.set(key, value, ttl, cache.ttlHard)
+}
+
+func (cache RedisCache) SetNegative(key string, value interface{}) error {
+	return cache.set(key, value, cache.ttlNegative, cache.ttlNegative)
+}
+
+func (cache RedisCache) set(key string, value interface{}, ttlFresh, ttlExpires time.Duration) error {
 	if value == nil {
 		panic("value shouldn't be nil")
 	}
@@ -60,16 +75,24 @@ func (cache RedisCache) Set(key string, value interface{}) error {
 		return err
 	}
 	defer conn.Close()
-	b := bytes.NewBuffer(nil)
-	encoder := json.NewEncoder(b)
-	err = encoder.Encode(&value)
+	b, err := encodeEntry(value, ttlFresh, ttlExpires)
 	if err != nil {
 		return err
 	}
-	_, err = conn.Do("SET", key, b, "EX", fmt.Sprintf("%v", cache.ttlData.Seconds()))
+	_, err = conn.Do("SET", key, b, "EX", expireSeconds(ttlExpires))
 	return err
 }
 
+// expireSeconds is the EX argument of SET for a ttl, which only takes whole seconds. It's rounded up
+// so that keys don't expire before their entries do.
+func expireSeconds(ttl time.Duration) string {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
 func (cache RedisCache) Lock(key string) (int, error) {
 	conn, err := redis.Dial("tcp", cache.url)
 	defer conn.Close()
@@ -80,7 +103,7 @@ func (cache RedisCache) Lock(key string) (int, error) {
 	now := time.Now()
 	expiration := cache.ttlData.Nanoseconds() / 10
 	for taken := int64(0); taken < expiration; taken = time.Now().Sub(now).Nanoseconds() {
-		if res, err := conn.Do("SET", "lock:"+key, lockId, "EX", fmt.Sprintf("%v", cache.ttlLock.Seconds())); err != nil {
+		if res, err := conn.Do("SET", "lock:"+key, lockId, "EX", expireSeconds(cache.ttlLock)); err != nil {
 			return 0, err
 		} else if res == "OK" {
 			return lockId, nil
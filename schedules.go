@@ -0,0 +1,87 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "strings"
+import "time"
+
+// Timezones holds the location of every agency, the schedules of NextBus are in local time
+// but the feed doesn't tell which one.
+type Timezones struct {
+	fallback *time.Location
+	agencies map[string]*time.Location
+}
+
+func NewTimezones(fallback *time.Location, agencies map[string]*time.Location) Timezones {
+	return Timezones{fallback, agencies}
+}
+
+func (timezones Timezones) Location(agencyTag string) *time.Location {
+	if location, ok := timezones.agencies[agencyTag]; ok {
+		return location
+	}
+	return timezones.fallback
+}
+
+// serviceDays are the weekdays of the service classes used by the agencies, i.e. wkd, sat and sun for sf-muni.
+var serviceDays = map[string][]time.Weekday{
+	"wkd":      {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekday":  {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"mtwtf":    {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"sat":      {time.Saturday},
+	"saturday": {time.Saturday},
+	"sun":      {time.Sunday},
+	"sunday":   {time.Sunday},
+	"wkend":    {time.Saturday, time.Sunday},
+	"weekend":  {time.Saturday, time.Sunday},
+	"daily":    {time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+}
+
+func servesWeekday(serviceClass string, weekday time.Weekday) bool {
+	for _, day := range serviceDays[strings.ToLower(serviceClass)] {
+		if day == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceDate returns the midnight of the day of a time in the agency timezone. The epoch times
+// of the schedules are milliseconds of wall clock since that midnight.
+func serviceDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// scheduleTime turns a schedule epoch time into a timestamp of a service date. The epoch is added to the
+// wall clock rather than to the elapsed time, which differ on the days that daylight saving time changes.
+func scheduleTime(date time.Time, epoch int) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, epoch/1000, epoch%1000*int(time.Millisecond), date.Location())
+}
+
+// GetServiceSchedules returns the schedules of a route that run on the weekday of a service date.
+func (nb NextBus) GetServiceSchedules(agencyTag, routeTag string, date time.Time) ([]nextbus.Schedule, error) {
+	schedules, err := nb.GetSchedules(agencyTag, routeTag)
+	if err != nil {
+		return nil, err
+	}
+	return serviceSchedules(schedules, date), nil
+}
+
+func serviceSchedules(schedules []nextbus.Schedule, date time.Time) []nextbus.Schedule {
+	service := []nextbus.Schedule{}
+	for _, schedule := range schedules {
+		if servesWeekday(schedule.ServiceClass, date.Weekday()) {
+			service = append(service, schedule)
+		}
+	}
+	return service
+}
+
+// knownServiceClasses tells if any of the schedules has a service class which days are known.
+func knownServiceClasses(schedules []nextbus.Schedule) bool {
+	for _, schedule := range schedules {
+		if _, ok := serviceDays[strings.ToLower(schedule.ServiceClass)]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+import "time"
+
+func TestScheduleTimeKeepsTheWallClockOnDaylightSavingChanges(t *testing.T) {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	cases := []struct {
+		date     time.Time
+		epoch    int
+		expected time.Time
+	}{
+		{time.Date(2026, 3, 8, 0, 0, 0, 0, location), 8 * 3600 * 1000, time.Date(2026, 3, 8, 8, 0, 0, 0, location)},
+		{time.Date(2026, 11, 1, 0, 0, 0, 0, location), 8 * 3600 * 1000, time.Date(2026, 11, 1, 8, 0, 0, 0, location)},
+		{time.Date(2026, 3, 7, 0, 0, 0, 0, location), 25*3600*1000 + 1500, time.Date(2026, 3, 8, 1, 0, 1, 500000000, location)},
+	}
+	for _, c := range cases {
+		if actual := scheduleTime(c.date, c.epoch); !actual.Equal(c.expected) {
+			t.Errorf("scheduleTime(%v, %v) = %v, expected %v", c.date, c.epoch, actual, c.expected)
+		}
+	}
+}
+
+func TestServesWeekday(t *testing.T) {
+	if !servesWeekday("wkd", time.Friday) || servesWeekday("wkd", time.Saturday) {
+		t.Error("wkd should serve the weekdays only")
+	}
+	if !servesWeekday("Sat", time.Saturday) || servesWeekday("unknown", time.Saturday) {
+		t.Error("service classes should be case insensitive and unknown ones serve no day")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "github.com/emicklei/go-restful"
+
+func bootstrapAnalyticsService(ws *restful.WebService, nextBus NextBus, recorder AccuracyRecorder, onTime OnTimeRecorder) {
+	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/accuracy").To(recorder.accuracy))
+	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/ontime").To(onTime.onTime))
+	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/headways").To(nextBus.headways))
+}
+
+func (recorder *AccuracyRecorder) accuracy(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	routeTag := req.PathParameter("route")
+	accuracy, err := recorder.GetRouteAccuracy(agencyTag, routeTag)
+	respond(resp, accuracy, err)
+}
+
+func (nb *NextBus) headways(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	routeTag := req.PathParameter("route")
+	headways, err := nb.GetRouteHeadways(agencyTag, routeTag)
+	respond(resp, headways, err)
+}
+
+func (recorder *OnTimeRecorder) onTime(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	routeTag := req.PathParameter("route")
+	date, err := recorder.serviceTime(agencyTag, req.QueryParameter("date"), "0")
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	report, err := recorder.GetOnTimeReport(agencyTag, routeTag, date)
+	respond(resp, report, err)
+}
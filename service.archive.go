@@ -0,0 +1,153 @@
+package main
+
+import "github.com/emicklei/go-restful"
+import "encoding/json"
+import "net/http"
+import "strconv"
+import "time"
+import "fmt"
+import "log"
+
+type Replays struct {
+	archive   Archive
+	heartbeat time.Duration
+}
+
+func bootstrapArchiveService(ws *restful.WebService, archive Archive, heartbeat time.Duration) {
+	replays := Replays{archive, heartbeat}
+	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/vehicles/trails").To(archive.routeTrails))
+	ws.Route(ws.GET("/agencies/{agency}/vehicles/{vehicle}/trail").To(archive.vehicleTrail))
+	ws.Route(ws.GET("/agencies/{agency}/vehicles/replay").To(replays.replay).
+		Produces("text/event-stream"))
+}
+
+func (archive *Archive) routeTrails(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	archive.trails(req, resp, agencyTag, req.PathParameter("route"), req.QueryParameter("vehicle"))
+}
+
+func (archive *Archive) vehicleTrail(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	archive.trails(req, resp, agencyTag, req.QueryParameter("route"), req.PathParameter("vehicle"))
+}
+
+func (archive *Archive) trails(req *restful.Request, resp *restful.Response, agencyTag, routeTag, vehicleId string) {
+	from, to, err := archive.window(agencyTag, req)
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	trails, err := archive.GetTrails(agencyTag, routeTag, vehicleId, from, to)
+	respond(resp, trails, err)
+}
+
+// window reads the times of the day from and to (hh, hh:mm or hh:mm:ss) of a date, which default
+// to the whole day.
+func (archive *Archive) window(agencyTag string, req *restful.Request) (time.Time, time.Time, error) {
+	fromStr, toStr := req.QueryParameter("from"), req.QueryParameter("to")
+	if fromStr == "" {
+		fromStr = "00:00:00"
+	}
+	if toStr == "" {
+		toStr = "23:59:59"
+	}
+	from, err := archive.serviceTime(agencyTag, req.QueryParameter("date"), fromStr)
+	if err != nil {
+		return from, from, err
+	}
+	to, err := archive.serviceTime(agencyTag, req.QueryParameter("date"), toStr)
+	if err != nil {
+		return from, to, err
+	}
+	if to.Before(from) {
+		return from, to, BadRequest("to should be after from")
+	}
+	return from, to, nil
+}
+
+// replay streams the vehicle locations archived during a day as Server-Sent Events, starting at the
+// time of the day from and waiting between the snapshots as long as they were apart divided by speed.
+// An end event is sent after the last snapshot, clients should close the connection then instead of
+// reconnecting, which would start the replay over.
+func (replays *Replays) replay(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	routeTag := req.QueryParameter("route")
+	from, _, err := replays.archive.window(agencyTag, req)
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	speed := 1.0
+	if speedStr := req.QueryParameter("speed"); speedStr != "" {
+		if speed, err = strconv.ParseFloat(speedStr, 64); err != nil {
+			respond(resp, nil, err)
+			return
+		}
+		if speed <= 0 {
+			respond(resp, nil, BadRequest("speed should be greater than zero"))
+			return
+		}
+	}
+	flusher, ok := resp.ResponseWriter.(http.Flusher)
+	if !ok {
+		resp.WriteErrorString(500, "500: Internal Server Error")
+		return
+	}
+	resp.AddHeader("Content-Type", "text/event-stream")
+	resp.AddHeader("Cache-Control", "no-cache")
+	resp.AddHeader("X-Accel-Buffering", "no")
+	resp.WriteHeader(200)
+	flusher.Flush()
+	heartbeat := time.NewTicker(replays.heartbeat)
+	defer heartbeat.Stop()
+	var previous time.Time
+	err = replays.archive.ReadSegment(agencyTag, serviceDate(from), func(snapshot ArchivedSnapshot) bool {
+		if snapshot.Time.Before(from) {
+			return true
+		}
+		if !previous.IsZero() {
+			wait := time.NewTimer(time.Duration(float64(snapshot.Time.Sub(previous)) / speed))
+			defer wait.Stop()
+			for waiting := true; waiting; {
+				select {
+				case <-wait.C:
+					waiting = false
+				case <-heartbeat.C:
+					if _, err := fmt.Fprint(resp, ": heartbeat\n\n"); err != nil {
+						return false
+					}
+					flusher.Flush()
+				case <-req.Request.Context().Done():
+					return false
+				}
+			}
+		}
+		previous = snapshot.Time
+		if routeTag != "" {
+			vehicles := []Vehicle{}
+			for _, vehicle := range snapshot.Vehicles {
+				if vehicle.RouteTag == routeTag {
+					vehicles = append(vehicles, vehicle)
+				}
+			}
+			snapshot.Vehicles = vehicles
+		}
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return false
+		}
+		if _, err = fmt.Fprintf(resp, "event: vehicles\ndata: %s\n\n", data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	})
+	if err != nil {
+		log.Printf("Replaying vehicles of agency <%v> failed: %v", agencyTag, err.Error())
+		return
+	}
+	if req.Request.Context().Err() == nil {
+		fmt.Fprint(resp, "event: end\ndata: {}\n\n")
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "github.com/emicklei/go-restful"
+import "google.golang.org/protobuf/encoding/prototext"
+import "google.golang.org/protobuf/proto"
+
+func bootstrapRealtimeService(ws *restful.WebService, nextBus NextBus) {
+	ws.Route(ws.GET("/agencies/{agency}/gtfs-rt").To(nextBus.realtimeFeed).
+		Produces("application/x-protobuf", "text/plain"))
+}
+
+// realtimeFeed writes the feed in protobuf, or in the debug text format when format=text.
+func (nb *NextBus) realtimeFeed(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	feed, err := nb.GetRealtimeFeed(agencyTag)
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	if req.QueryParameter("format") == "text" {
+		resp.AddHeader("Content-Type", "text/plain")
+		resp.Write([]byte(prototext.Format(feed)))
+		return
+	}
+	b, err := proto.Marshal(feed)
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	resp.AddHeader("Content-Type", "application/x-protobuf")
+	resp.Write(b)
+}
@@ -1,11 +1,12 @@
 package main
 
 import "github.com/emicklei/go-restful"
+import "strconv"
+import "strings"
 import "time"
 import "fmt"
 
-func bootstrapNextBusService(ws *restful.WebService, cache Cacher) {
-	nextBus := NextBus{cache}
+func bootstrapNextBusService(ws *restful.WebService, nextBus NextBus) {
 	ws.Route(ws.GET("/agencies").To(nextBus.agencies))
 	ws.Route(ws.GET("/agencies/{agency}").To(nextBus.agency))
 	ws.Route(ws.GET("/agencies/{agency}/routes").To(nextBus.routes))
@@ -13,7 +14,18 @@ func bootstrapNextBusService(ws *restful.WebService, cache Cacher) {
 	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/stops").To(nextBus.stops))
 	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/stops/{stop}").To(nextBus.stop))
 	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/stops/{stop}/predictions").To(nextBus.predictions))
+	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/stops/{stop}/departures").To(nextBus.departures))
+	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/geometry").To(nextBus.geometry))
+	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/directions").To(nextBus.directions))
+	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/directions/{direction}/stops").To(nextBus.directionStops))
 	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/schedules").To(nextBus.schedules))
+	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/vehicles").To(nextBus.vehicles))
+
+	ws.Route(ws.GET("/agencies/{agency}/messages").To(nextBus.messages))
+	ws.Route(ws.GET("/agencies/{agency}/predictions").To(nextBus.multiStopPredictions))
+	ws.Route(ws.GET("/agencies/{agency}/stops/nearby").To(nextBus.nearbyStops))
+	ws.Route(ws.GET("/agencies/{agency}/stops/{stop}/board").To(nextBus.departureBoard))
+	ws.Route(ws.GET("/agencies/{agency}/plan").To(nextBus.planTrip))
 
 	ws.Route(ws.GET("/agencies/{agency}/routes/availability").To(nextBus.routesAvailability))
 }
@@ -57,6 +69,32 @@ func (nb *NextBus) stop(req *restful.Request, resp *restful.Response) {
 	respond(resp, stop, err)
 }
 
+func (nb *NextBus) geometry(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	routeTag := req.PathParameter("route")
+	geometry, err := nb.GetRouteGeometry(agencyTag, routeTag)
+	respond(resp, geometry, err)
+}
+
+func (nb *NextBus) directions(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	routeTag := req.PathParameter("route")
+	directions, err := nb.GetDirections(agencyTag, routeTag)
+	respond(resp, directions, err)
+}
+
+func (nb *NextBus) directionStops(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	routeTag := req.PathParameter("route")
+	directionTag := req.PathParameter("direction")
+	direction, err := nb.GetDirection(agencyTag, routeTag, directionTag)
+	if err != nil || direction == nil {
+		respond(resp, nil, err)
+		return
+	}
+	respond(resp, direction.Stops, nil)
+}
+
 func (nb *NextBus) predictions(req *restful.Request, resp *restful.Response) {
 	agencyTag := req.PathParameter("agency")
 	routeTag := req.PathParameter("route")
@@ -65,6 +103,108 @@ func (nb *NextBus) predictions(req *restful.Request, resp *restful.Response) {
 	respond(resp, predictions, err)
 }
 
+func (nb *NextBus) departures(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	routeTag := req.PathParameter("route")
+	stopTag := req.PathParameter("stop")
+	from, err := nb.serviceTime(agencyTag, req.QueryParameter("date"), req.QueryParameter("from"))
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	limit, err := limitParameter(req, 10)
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	departures, err := nb.GetScheduledDepartures(agencyTag, routeTag, stopTag, req.QueryParameter("direction"), from, limit)
+	respond(resp, departures, err)
+}
+
+// multiStopPredictions expects one or more stops parameters as route|stop pairs.
+func (nb *NextBus) multiStopPredictions(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	stops := []PredictedStop{}
+	for _, pair := range req.Request.URL.Query()["stops"] {
+		tags := strings.Split(pair, "|")
+		if len(tags) != 2 || tags[0] == "" || tags[1] == "" {
+			respond(resp, nil, BadRequest("stops should be route|stop pairs: "+pair))
+			return
+		}
+		stops = append(stops, PredictedStop{tags[0], tags[1]})
+	}
+	if len(stops) == 0 {
+		respond(resp, nil, BadRequest("at least one stops parameter is required"))
+		return
+	}
+	predictions, err := nb.GetMultiStopPredictions(agencyTag, stops)
+	respond(resp, predictions, err)
+}
+
+func (nb *NextBus) nearbyStops(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	lat, err := strconv.ParseFloat(req.QueryParameter("lat"), 64)
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	lon, err := strconv.ParseFloat(req.QueryParameter("lon"), 64)
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	radius := 500.0
+	if radiusStr := req.QueryParameter("radius"); radiusStr != "" {
+		if radius, err = strconv.ParseFloat(radiusStr, 64); err != nil {
+			respond(resp, nil, err)
+			return
+		}
+	}
+	stops, err := nb.GetNearbyStops(agencyTag, lat, lon, radius)
+	respond(resp, stops, err)
+}
+
+func (nb *NextBus) departureBoard(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	stopTag := req.PathParameter("stop")
+	limit, err := limitParameter(req, 20)
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	board, err := nb.GetDepartureBoard(agencyTag, stopTag, limit)
+	if err != nil || board == nil {
+		respond(resp, nil, err)
+		return
+	}
+	respond(resp, board, nil)
+}
+
+func (nb *NextBus) planTrip(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	fromTag, toTag := req.QueryParameter("from"), req.QueryParameter("to")
+	if fromTag == "" || toTag == "" {
+		respond(resp, nil, BadRequest("from and to stops are required"))
+		return
+	}
+	at, err := nb.serviceTime(agencyTag, req.QueryParameter("date"), req.QueryParameter("time"))
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	limit, err := limitParameter(req, 5)
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	plan, err := nb.PlanTrip(agencyTag, fromTag, toTag, at, limit)
+	if err != nil || plan == nil {
+		respond(resp, nil, err)
+		return
+	}
+	respond(resp, plan, nil)
+}
+
 func (nb *NextBus) schedules(req *restful.Request, resp *restful.Response) {
 	agencyTag := req.PathParameter("agency")
 	routeTag := req.PathParameter("route")
@@ -72,12 +212,64 @@ func (nb *NextBus) schedules(req *restful.Request, resp *restful.Response) {
 	respond(resp, schedules, err)
 }
 
+func (nb *NextBus) vehicles(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	routeTag := req.PathParameter("route")
+	since := int64(0)
+	if t := req.QueryParameter("t"); t != "" {
+		var err error
+		if since, err = strconv.ParseInt(t, 10, 64); err != nil {
+			respond(resp, nil, err)
+			return
+		}
+	}
+	vehicles, err := nb.GetVehicleLocations(agencyTag, routeTag, since)
+	respond(resp, vehicles, err)
+}
+
+func (nb *NextBus) messages(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	routeTag := req.QueryParameter("route")
+	messages, err := nb.GetMessages(agencyTag, routeTag)
+	respond(resp, messages, err)
+}
+
 func (nb *NextBus) routesAvailability(req *restful.Request, resp *restful.Response) {
 	agencyTag := req.PathParameter("agency")
-	timeStr := req.QueryParameter("time")
+	at, err := nb.serviceTime(agencyTag, req.QueryParameter("date"), req.QueryParameter("time"))
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	availability, err := nb.GetRoutesAvailability(agencyTag, at)
+	respond(resp, availability, err)
+}
+
+func limitParameter(req *restful.Request, limit int) (int, error) {
+	limitStr := req.QueryParameter("limit")
+	if limitStr == "" {
+		return limit, nil
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 1 {
+		return 0, BadRequest("limit should be greater than zero")
+	}
+	return limit, nil
+}
+
+// serviceTime parses a date (yyyy-mm-dd) and a time of the day (hh, hh:mm or hh:mm:ss) in the agency
+// timezone, both default to the current ones.
+func (nb *NextBus) serviceTime(agencyTag, dateStr, timeStr string) (time.Time, error) {
+	now := time.Now().In(nb.timezones.Location(agencyTag))
+	if dateStr == "" {
+		dateStr = now.Format("2006-01-02")
+	}
 	switch len(timeStr) {
 	case 0:
-		timeStr = time.Now().Format("15:04:05")
+		timeStr = now.Format("15:04:05")
 	case 1:
 		timeStr = fmt.Sprintf("0%v:00:00", timeStr)
 	case 2:
@@ -87,11 +279,5 @@ func (nb *NextBus) routesAvailability(req *restful.Request, resp *restful.Respon
 	case 5:
 		timeStr = fmt.Sprintf("%v:00", timeStr)
 	}
-	time, err := time.Parse("2006-01-03 15:04:05", "1970-01-01 "+timeStr)
-	if err != nil {
-		respond(resp, nil, err)
-		return
-	}
-	availability, err := nb.GetRoutesAvailability(agencyTag, int(time.Unix()*1000))
-	respond(resp, availability, err)
+	return time.ParseInLocation("2006-01-02 15:04:05", dateStr+" "+timeStr, now.Location())
 }
@@ -0,0 +1,125 @@
+package main
+
+import "github.com/emicklei/go-restful"
+import "net/http/httptest"
+import "encoding/json"
+import "sync/atomic"
+import "net/http"
+import "testing"
+import "time"
+
+// newTestService serves the NextBus endpoints from the fixtures thru an in-process cache.
+func newTestService(t *testing.T, ttlData, ttlHard time.Duration) (*httptest.Server, *int32) {
+	calls := new(int32)
+	nextBus := newTestNextBusFor(countingUpstream{loadTestFixtures(t), calls}, ttlData, ttlHard)
+	ws := new(restful.WebService)
+	ws.Path("/api").Consumes(restful.MIME_JSON).Produces(restful.MIME_JSON)
+	bootstrapNextBusService(ws, nextBus)
+	container := restful.NewContainer()
+	container.Add(ws)
+	server := httptest.NewServer(container)
+	t.Cleanup(server.Close)
+	return server, calls
+}
+
+func get(t *testing.T, server *httptest.Server, path string, value interface{}) int {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if value != nil {
+		if err = json.NewDecoder(resp.Body).Decode(value); err != nil {
+			t.Fatalf("GET %v: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAgencies(t *testing.T) {
+	server, _ := newTestService(t, time.Minute, time.Hour)
+	agencies := []map[string]interface{}{}
+	if status := get(t, server, "/api/agencies", &agencies); status != 200 {
+		t.Fatalf("expected 200, got %v", status)
+	}
+	if len(agencies) != 1 || agencies[0]["Tag"] != "sf-muni" {
+		t.Errorf("unexpected agencies %v", agencies)
+	}
+}
+
+func TestPredictionsFreshAreServedFromTheCache(t *testing.T) {
+	server, calls := newTestService(t, time.Minute, time.Hour)
+	for i := 0; i < 3; i++ {
+		predictions := StopPredictions{}
+		if status := get(t, server, "/api/agencies/sf-muni/routes/N/stops/5205/predictions", &predictions); status != 200 {
+			t.Fatalf("expected 200, got %v", status)
+		}
+		if predictions.StopTag != "5205" || len(predictions.Direction) == 0 {
+			t.Fatalf("unexpected predictions %+v", predictions)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("expected a single upstream call, got %v", n)
+	}
+}
+
+func TestPredictionsStaleAreServedWhileRefreshed(t *testing.T) {
+	server, calls := newTestService(t, 10*time.Millisecond, time.Hour)
+	get(t, server, "/api/agencies/sf-muni/routes/N/stops/5205/predictions", nil)
+	time.Sleep(20 * time.Millisecond)
+	predictions := StopPredictions{}
+	if status := get(t, server, "/api/agencies/sf-muni/routes/N/stops/5205/predictions", &predictions); status != 200 {
+		t.Fatalf("expected the stale value with 200, got %v", status)
+	}
+	if predictions.StopTag != "5205" {
+		t.Fatalf("unexpected predictions %+v", predictions)
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(calls) < 2; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the stale value wasn't refreshed in the background")
+		}
+	}
+}
+
+func TestPredictionsUnavailableAreNegativelyCached(t *testing.T) {
+	server, calls := newTestService(t, time.Minute, time.Hour)
+	for i := 0; i < 2; i++ {
+		unavailable := Unavailable{}
+		if status := get(t, server, "/api/agencies/sf-muni/routes/N/stops/missing/predictions", &unavailable); status != 503 {
+			t.Fatalf("expected 503, got %v", status)
+		}
+		if unavailable.Status != "upstream unavailable" {
+			t.Errorf("unexpected entity %+v", unavailable)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("expected the null response to be remembered, got %v upstream calls", n)
+	}
+}
+
+func TestPredictionsAreNormalized(t *testing.T) {
+	memory := NewMemoryUpstream()
+	memory.Predictions["sf-muni/N/1"] = &StopPredictions{StopTag: "1", Direction: []PredictionsDirection{{Title: "Inbound"}}}
+	memory.Predictions["sf-muni/N/2"] = &StopPredictions{StopTag: "2", DirTitleBecauseNoPredictions: "Outbound"}
+	nextBus := newTestNextBus(memory)
+	for _, stopTag := range []string{"1", "2"} {
+		predictions, err := nextBus.GetPredictions("sf-muni", "N", stopTag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(predictions)
+		raw := map[string]interface{}{}
+		json.Unmarshal(b, &raw)
+		if _, ok := raw["Direction"].([]interface{}); !ok {
+			t.Errorf("Direction of stop %v should be a list: %s", stopTag, b)
+		}
+		if _, ok := raw["Message"].([]interface{}); !ok {
+			t.Errorf("Message of stop %v should be a list: %s", stopTag, b)
+		}
+		for _, direction := range predictions.Direction {
+			if direction.Prediction == nil {
+				t.Errorf("Prediction of stop %v should be a list: %s", stopTag, b)
+			}
+		}
+	}
+}
@@ -88,6 +88,13 @@ func (counter StatsCounter) times(req *restful.Request, resp *restful.Response)
 	respond(resp, times, nil)
 }
 
+// BadRequest is returned by the handlers when a parameter is malformed.
+type BadRequest string
+
+func (badRequest BadRequest) Error() string {
+	return string(badRequest)
+}
+
 func respond(resp *restful.Response, entity interface{}, err error) {
 	if err != nil {
 		switch err.(type) {
@@ -95,6 +102,10 @@ func respond(resp *restful.Response, entity interface{}, err error) {
 			resp.WriteErrorString(400, "400: Bad Request")
 		case *strconv.NumError:
 			resp.WriteErrorString(400, "400: Bad Request")
+		case BadRequest:
+			resp.WriteErrorString(400, "400: Bad Request: "+err.Error())
+		case Unavailable:
+			resp.WriteHeaderAndEntity(503, err)
 		default:
 			log.Print(err.Error())
 			resp.WriteErrorString(500, "500: Internal Server Error")
@@ -0,0 +1,57 @@
+package main
+
+import "github.com/emicklei/go-restful"
+import "github.com/gorilla/websocket"
+import "net/http"
+import "time"
+import "fmt"
+
+type Streams struct {
+	hub       *Hub
+	heartbeat time.Duration
+	upgrader  websocket.Upgrader
+}
+
+func bootstrapStreamService(ws *restful.WebService, hub *Hub, heartbeat time.Duration, origins []string) {
+	streams := Streams{hub, heartbeat, newWebsocketUpgrader(origins)}
+	ws.Route(ws.GET("/agencies/{agency}/routes/{route}/stops/{stop}/predictions/stream").To(streams.predictions).
+		Produces("text/event-stream"))
+	ws.Route(ws.GET("/stream").To(streams.subscriptions))
+}
+
+// predictions pushes the predictions of a stop as Server-Sent Events whenever they change,
+// with comments as heartbeats in between so that proxies don't close the connection.
+func (streams *Streams) predictions(req *restful.Request, resp *restful.Response) {
+	agencyTag := req.PathParameter("agency")
+	stop := PredictedStop{req.PathParameter("route"), req.PathParameter("stop")}
+	flusher, ok := resp.ResponseWriter.(http.Flusher)
+	if !ok {
+		resp.WriteErrorString(500, "500: Internal Server Error")
+		return
+	}
+	topic := predictionsTopic(agencyTag, stop)
+	updates := streams.hub.Subscribe(topic)
+	defer streams.hub.Unsubscribe(topic, updates)
+	resp.AddHeader("Content-Type", "text/event-stream")
+	resp.AddHeader("Cache-Control", "no-cache")
+	resp.AddHeader("X-Accel-Buffering", "no")
+	resp.WriteHeader(200)
+	flusher.Flush()
+	heartbeat := time.NewTicker(streams.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case data := <-updates:
+			_, err = fmt.Fprintf(resp, "event: predictions\ndata: %s\n\n", data)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(resp, ": heartbeat\n\n")
+		case <-req.Request.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
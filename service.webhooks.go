@@ -0,0 +1,49 @@
+package main
+
+import "github.com/emicklei/go-restful"
+
+func bootstrapWebhooksService(ws *restful.WebService, webhooks Webhooks) {
+	ws.Route(ws.GET("/webhooks").To(webhooks.list))
+	ws.Route(ws.POST("/webhooks").To(webhooks.create))
+	ws.Route(ws.GET("/webhooks/{id}").To(webhooks.get))
+	ws.Route(ws.DELETE("/webhooks/{id}").To(webhooks.delete))
+}
+
+// list responds with the webhooks created with the token in the query.
+func (webhooks *Webhooks) list(req *restful.Request, resp *restful.Response) {
+	listed, err := webhooks.GetTokenWebhooks(req.QueryParameter("token"))
+	respond(resp, listed, err)
+}
+
+// get responds with a single webhook, the ids are only known to whoever created them.
+func (webhooks *Webhooks) get(req *restful.Request, resp *restful.Response) {
+	webhook, err := webhooks.GetWebhook(req.PathParameter("id"))
+	if err != nil || webhook == nil {
+		respond(resp, nil, err)
+		return
+	}
+	respond(resp, webhook, nil)
+}
+
+func (webhooks *Webhooks) create(req *restful.Request, resp *restful.Response) {
+	webhook := Webhook{}
+	if err := req.ReadEntity(&webhook); err != nil {
+		respond(resp, nil, BadRequest(err.Error()))
+		return
+	}
+	created, err := webhooks.CreateWebhook(webhook)
+	if err != nil {
+		respond(resp, nil, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(201, created)
+}
+
+func (webhooks *Webhooks) delete(req *restful.Request, resp *restful.Response) {
+	deleted, err := webhooks.DeleteWebhook(req.PathParameter("id"))
+	if err != nil || !deleted {
+		respond(resp, nil, err)
+		return
+	}
+	resp.WriteHeader(204)
+}
@@ -0,0 +1,186 @@
+package main
+
+import "github.com/emicklei/go-restful"
+import "github.com/gorilla/websocket"
+import "encoding/json"
+import "net/http"
+import "net/url"
+import "strings"
+import "time"
+
+// websocketWriteWait is how long a write can take before the client is considered gone.
+const websocketWriteWait = 10 * time.Second
+
+// websocketBuffer is the amount of messages queued for a client, once full every topic waits
+// for the client while keeping only its latest update.
+const websocketBuffer = 16
+
+const websocketMaxTopics = 100
+
+// newWebsocketUpgrader accepts the connections from the pages served by the api itself and from the
+// allowed origins, "*" allowing any of them. Clients other than browsers don't send an origin and are
+// always accepted.
+func newWebsocketUpgrader(origins []string) websocket.Upgrader {
+	allowed := map[string]bool{}
+	for _, origin := range origins {
+		allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowed["*"] || allowed[strings.ToLower(origin)] {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}}
+}
+
+// SubscriptionRequest is sent by the clients, Type is either subscribe or unsubscribe.
+type SubscriptionRequest struct {
+	Type  string
+	Topic string
+}
+
+// SubscriptionMessage is sent to the clients, Type is subscribed, unsubscribed, update (along with
+// the Data of the topic) or error (along with a Message).
+type SubscriptionMessage struct {
+	Type    string
+	Topic   string
+	Data    json.RawMessage `json:",omitempty"`
+	Message string          `json:",omitempty"`
+}
+
+type subscriptionConnection struct {
+	conn     *websocket.Conn
+	hub      *Hub
+	outgoing chan SubscriptionMessage
+	topics   map[string]chan bool
+	done     chan bool
+}
+
+// subscriptions upgrades the request to a WebSocket where the client can subscribe to many topics at once.
+func (streams *Streams) subscriptions(req *restful.Request, resp *restful.Response) {
+	conn, err := streams.upgrader.Upgrade(resp.ResponseWriter, req.Request, nil)
+	if err != nil {
+		// the upgrader already responded with the error
+		return
+	}
+	connection := &subscriptionConnection{conn, streams.hub, make(chan SubscriptionMessage, websocketBuffer),
+		map[string]chan bool{}, make(chan bool)}
+	go connection.write(streams.heartbeat)
+	connection.read(streams.heartbeat)
+}
+
+// read handles the requests of the client until it goes away, the client has to answer the pings
+// sent every heartbeat to keep the connection open.
+func (connection *subscriptionConnection) read(heartbeat time.Duration) {
+	defer func() {
+		close(connection.done)
+		connection.conn.Close()
+	}()
+	deadline := func() {
+		connection.conn.SetReadDeadline(time.Now().Add(2*heartbeat + websocketWriteWait))
+	}
+	deadline()
+	connection.conn.SetPongHandler(func(string) error {
+		deadline()
+		return nil
+	})
+	for {
+		_, data, err := connection.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		deadline()
+		request := SubscriptionRequest{}
+		if err = json.Unmarshal(data, &request); err != nil {
+			connection.send(SubscriptionMessage{"error", "", nil, "malformed request: " + err.Error()})
+			continue
+		}
+		switch request.Type {
+		case "subscribe":
+			connection.subscribe(request.Topic)
+		case "unsubscribe":
+			connection.unsubscribe(request.Topic)
+		default:
+			connection.send(SubscriptionMessage{"error", request.Topic, nil, "unknown request type: " + request.Type})
+		}
+	}
+}
+
+func (connection *subscriptionConnection) write(heartbeat time.Duration) {
+	ticker := time.NewTicker(heartbeat)
+	defer func() {
+		ticker.Stop()
+		connection.conn.Close()
+	}()
+	for {
+		var err error
+		connection.conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+		select {
+		case message := <-connection.outgoing:
+			err = connection.conn.WriteJSON(message)
+		case <-ticker.C:
+			err = connection.conn.WriteMessage(websocket.PingMessage, nil)
+		case <-connection.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (connection *subscriptionConnection) send(message SubscriptionMessage) {
+	select {
+	case connection.outgoing <- message:
+	case <-connection.done:
+	}
+}
+
+// subscribe forwards the updates of a topic from the hub to the client until it unsubscribes or goes away.
+func (connection *subscriptionConnection) subscribe(topic string) {
+	if _, ok := connection.topics[topic]; ok {
+		connection.send(SubscriptionMessage{"subscribed", topic, nil, ""})
+		return
+	}
+	if _, _, ok := parseTopic(topic); !ok {
+		connection.send(SubscriptionMessage{"error", topic, nil, "unknown topic"})
+		return
+	}
+	if len(connection.topics) >= websocketMaxTopics {
+		connection.send(SubscriptionMessage{"error", topic, nil, "too many topics"})
+		return
+	}
+	stop := make(chan bool)
+	connection.topics[topic] = stop
+	updates := connection.hub.Subscribe(topic)
+	connection.send(SubscriptionMessage{"subscribed", topic, nil, ""})
+	go func() {
+		defer connection.hub.Unsubscribe(topic, updates)
+		for {
+			select {
+			case data := <-updates:
+				select {
+				case connection.outgoing <- SubscriptionMessage{"update", topic, data, ""}:
+				case <-stop:
+					return
+				case <-connection.done:
+					return
+				}
+			case <-stop:
+				return
+			case <-connection.done:
+				return
+			}
+		}
+	}()
+}
+
+func (connection *subscriptionConnection) unsubscribe(topic string) {
+	if stop, ok := connection.topics[topic]; ok {
+		close(stop)
+		delete(connection.topics, topic)
+	}
+	connection.send(SubscriptionMessage{"unsubscribed", topic, nil, ""})
+}
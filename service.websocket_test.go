@@ -0,0 +1,88 @@
+package main
+
+import "github.com/emicklei/go-restful"
+import "github.com/gorilla/websocket"
+import "net/http/httptest"
+import "net/http"
+import "strings"
+import "testing"
+import "time"
+
+func newWebsocketServer(origins []string) *httptest.Server {
+	hub := NewHub(10*time.Millisecond, func(topic string) (interface{}, error) {
+		return map[string]string{"Topic": topic}, nil
+	})
+	ws := new(restful.WebService)
+	ws.Path("/api")
+	bootstrapStreamService(ws, hub, time.Minute, origins)
+	container := restful.NewContainer()
+	container.Add(ws)
+	return httptest.NewServer(container)
+}
+
+func websocketUrl(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/api/stream"
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) SubscriptionMessage {
+	message := SubscriptionMessage{}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestWebsocketSubscriptions(t *testing.T) {
+	server := newWebsocketServer(nil)
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(websocketUrl(server), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	topic := "predictions:sf-muni/N/5205"
+	for _, request := range []SubscriptionRequest{{"subscribe", "unknown"}, {"subscribe", topic}} {
+		if err = conn.WriteJSON(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if message := readMessage(t, conn); message.Type != "error" || message.Topic != "unknown" {
+		t.Errorf("expected an error for the unknown topic, got %+v", message)
+	}
+	if message := readMessage(t, conn); message.Type != "subscribed" || message.Topic != topic {
+		t.Errorf("expected the subscription, got %+v", message)
+	}
+	if message := readMessage(t, conn); message.Type != "update" || message.Topic != topic || !strings.Contains(string(message.Data), topic) {
+		t.Errorf("expected the update of the topic, got %+v", message)
+	}
+	if err = conn.WriteJSON(SubscriptionRequest{"unsubscribe", topic}); err != nil {
+		t.Fatal(err)
+	}
+	if message := readMessage(t, conn); message.Type != "unsubscribed" || message.Topic != topic {
+		t.Errorf("expected the subscription to end, got %+v", message)
+	}
+}
+
+func TestWebsocketOrigins(t *testing.T) {
+	server := newWebsocketServer([]string{"https://dashboard.example.com"})
+	defer server.Close()
+	for origin, allowed := range map[string]bool{
+		"":                              true,
+		server.URL:                      true,
+		"https://dashboard.example.com": true,
+		"https://evil.example.com":      false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(websocketUrl(server), header)
+		if (err == nil) != allowed {
+			t.Errorf("expected origin <%v> allowed %v, got %v", origin, allowed, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
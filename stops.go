@@ -0,0 +1,151 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "strconv"
+import "sort"
+import "math"
+import "time"
+import "log"
+
+// stopIndexCell is the size in degrees of the cells of the grid used to index the stops.
+const stopIndexCell = 0.01
+
+const earthRadius = 6371000.0
+
+type NearbyStop struct {
+	nextbus.Stop
+	Routes   []string
+	Distance float64
+}
+
+// StopIndex is a grid over the stops of all the routes of an agency. Version is the version of
+// the route configs in the cache that were used to build it.
+type StopIndex struct {
+	Version   int64
+	stops     []NearbyStop
+	positions []stopPosition
+	cells     map[[2]int][]int
+	tags      map[string]int
+}
+
+type stopPosition struct {
+	lat float64
+	lon float64
+}
+
+func stopIndexVersionKey(agencyTag string) string {
+	return "agencies/" + agencyTag + "/stops/version"
+}
+
+// touchStopIndex changes the version of the stops of an agency whenever a route config is stored,
+// so that the indexes built by every instance from the previous route configs get rebuilt.
+func (nb NextBus) touchStopIndex(agencyTag string) {
+	if err := nb.Set(stopIndexVersionKey(agencyTag), time.Now().UnixNano()); err != nil {
+		log.Print(err.Error())
+	}
+}
+
+func (nb NextBus) stopIndexVersion(agencyTag string) (int64, error) {
+	version := int64(0)
+	_, _, err := nb.Get(stopIndexVersionKey(agencyTag), &version)
+	return version, err
+}
+
+// GetStopIndex returns the index of the stops of an agency, building it again when the route configs changed.
+func (nb NextBus) GetStopIndex(agencyTag string) (*StopIndex, error) {
+	version, err := nb.stopIndexVersion(agencyTag)
+	if err != nil {
+		return nil, err
+	}
+	if index, ok := nb.stopIndexes.Load(agencyTag); ok && index.(*StopIndex).Version == version {
+		return index.(*StopIndex), nil
+	}
+	log.Printf("Building stop index for agency: %v", agencyTag)
+	routes, err := nb.GetRoutes(agencyTag)
+	if err != nil {
+		return nil, err
+	}
+	index := &StopIndex{stops: []NearbyStop{}, positions: []stopPosition{}, cells: map[[2]int][]int{}, tags: map[string]int{}}
+	for _, route := range routes {
+		config, err := nb.GetRouteConfig(agencyTag, route.Tag)
+		if err != nil {
+			log.Printf("Stops of route <%v> left out of the index: %v", route.Tag, err.Error())
+			continue
+		}
+		for _, stop := range config.Stop {
+			if i, ok := index.tags[stop.Tag]; ok {
+				index.stops[i].Routes = append(index.stops[i].Routes, route.Tag)
+				continue
+			}
+			lat, latErr := strconv.ParseFloat(stop.Lat, 64)
+			lon, lonErr := strconv.ParseFloat(stop.Lon, 64)
+			if latErr != nil || lonErr != nil {
+				continue
+			}
+			index.tags[stop.Tag] = len(index.stops)
+			cell := stopCell(lat, lon)
+			index.cells[cell] = append(index.cells[cell], len(index.stops))
+			index.stops = append(index.stops, NearbyStop{stop, []string{route.Tag}, 0})
+			index.positions = append(index.positions, stopPosition{lat, lon})
+		}
+	}
+	// the version read before building, route configs stored meanwhile make the next call build it again
+	index.Version = version
+	nb.stopIndexes.Store(agencyTag, index)
+	return index, nil
+}
+
+// GetNearbyStops returns the stops of an agency within the radius (in meters) of a location, closest first.
+func (nb NextBus) GetNearbyStops(agencyTag string, lat, lon, radius float64) ([]NearbyStop, error) {
+	index, err := nb.GetStopIndex(agencyTag)
+	if err != nil {
+		return nil, err
+	}
+	return index.Nearby(lat, lon, radius), nil
+}
+
+func (index *StopIndex) Nearby(lat, lon, radius float64) []NearbyStop {
+	nearby := []NearbyStop{}
+	latDelta := radius / earthRadius * 180 / math.Pi
+	lonDelta := latDelta / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	from, to := stopCell(lat-latDelta, lon-lonDelta), stopCell(lat+latDelta, lon+lonDelta)
+	for x := from[0]; x <= to[0]; x++ {
+		for y := from[1]; y <= to[1]; y++ {
+			for _, i := range index.cells[[2]int{x, y}] {
+				stop, position := index.stops[i], index.positions[i]
+				if stop.Distance = distance(lat, lon, position.lat, position.lon); stop.Distance <= radius {
+					nearby = append(nearby, stop)
+				}
+			}
+		}
+	}
+	sort.Sort(byDistance(nearby))
+	return nearby
+}
+
+// Stop returns a stop of the index by tag, along with the routes that serve it.
+func (index *StopIndex) Stop(stopTag string) *NearbyStop {
+	if i, ok := index.tags[stopTag]; ok {
+		return &index.stops[i]
+	}
+	return nil
+}
+
+func stopCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat / stopIndexCell)), int(math.Floor(lon / stopIndexCell))}
+}
+
+// distance is the haversine distance in meters between two locations.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+type byDistance []NearbyStop
+
+func (stops byDistance) Len() int           { return len(stops) }
+func (stops byDistance) Swap(i, j int)      { stops[i], stops[j] = stops[j], stops[i] }
+func (stops byDistance) Less(i, j int) bool { return stops[i].Distance < stops[j].Distance }
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestStopIndexIsBuiltAgainWhenRouteConfigsAreStored(t *testing.T) {
+	nb := newTestNextBus(loadTestFixtures(t))
+	// the route configs fetched while building the first index change the version
+	first, err := nb.GetStopIndex("sf-muni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := nb.stopIndexVersion("sf-muni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Version == version {
+		t.Fatal("the index should keep the version from before the route configs were stored")
+	}
+	second, _ := nb.GetStopIndex("sf-muni")
+	if second == first || second.Version != version {
+		t.Fatalf("expected the index to be built again with version %v, got %v", version, second.Version)
+	}
+	if third, _ := nb.GetStopIndex("sf-muni"); third != second {
+		t.Error("the index should be reused while the route configs don't change")
+	}
+	if len(second.stops) == 0 {
+		t.Error("expected the stops of the fixtures in the index")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "strings"
+import "errors"
+import "time"
+
+func predictionsTopic(agencyTag string, stop PredictedStop) string {
+	return "predictions:" + agencyTag + "/" + stop.RouteTag + "/" + stop.StopTag
+}
+
+// parseTopic splits the topics of the hub, which are the kind of data followed by the tags that identify it:
+// predictions:agency/route/stop, vehicles:agency/route or vehicles:agency for the vehicles of all the routes.
+func parseTopic(topic string) (kind string, tags []string, ok bool) {
+	parts := strings.SplitN(topic, ":", 2)
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	kind, tags = parts[0], strings.Split(parts[1], "/")
+	for _, tag := range tags {
+		if tag == "" {
+			return "", nil, false
+		}
+	}
+	switch {
+	case kind == "predictions" && len(tags) == 3:
+		return kind, tags, true
+	case kind == "vehicles" && (len(tags) == 1 || len(tags) == 2):
+		return kind, tags, true
+	}
+	return "", nil, false
+}
+
+// PollTopic returns the current value of a topic of the hub.
+func (nb NextBus) PollTopic(topic string, interval time.Duration) (interface{}, error) {
+	kind, tags, ok := parseTopic(topic)
+	if !ok {
+		return nil, errors.New("unknown topic: " + topic)
+	}
+	switch kind {
+	case "predictions":
+		return nb.PollPredictions(tags[0], PredictedStop{tags[1], tags[2]}, interval)
+	default:
+		routeTag := ""
+		if len(tags) == 2 {
+			routeTag = tags[1]
+		}
+		// vehicle locations are already refreshed every ttlVehicles
+		return nb.GetVehicleLocations(tags[0], routeTag, 0)
+	}
+}
+
+// PollPredictions refreshes the predictions of a stop if nobody did it during the last interval, no matter
+// how many instances are polling them, then returns them from the cache. The predictions of the stops
+// with subscribers are kept much fresher than ttlData this way.
+func (nb NextBus) PollPredictions(agencyTag string, stop PredictedStop, interval time.Duration) (*StopPredictions, error) {
+	cacheValueKey := predictionsKey(agencyTag, stop)
+	claimed, err := nb.claim("polled:"+cacheValueKey, interval)
+	if err != nil {
+		return nil, err
+	}
+	if claimed {
+		// fetched under the lock of the predictions, so the misses of GetPredictions meanwhile wait for them
+		lockId, err := nb.Lock(cacheValueKey)
+		if err != nil {
+			return nil, err
+		}
+		_, err = nb.fetch(cacheValueKey, 0, nb.fetchPredictions(agencyTag, stop), nil)
+		nb.Unlock(cacheValueKey, lockId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nb.GetPredictions(agencyTag, stop.RouteTag, stop.StopTag)
+}
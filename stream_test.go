@@ -0,0 +1,55 @@
+package main
+
+import "sync/atomic"
+import "testing"
+import "time"
+
+func newPollingNextBus(t *testing.T) (NextBus, *int32) {
+	calls := new(int32)
+	return newTestNextBus(countingUpstream{loadTestFixtures(t), calls}), calls
+}
+
+func TestPollPredictionsOncePerInterval(t *testing.T) {
+	nb, calls := newPollingNextBus(t)
+	stop := PredictedStop{"N", "5205"}
+	for i := 0; i < 3; i++ {
+		predictions, err := nb.PollPredictions("sf-muni", stop, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if predictions.StopTag != "5205" {
+			t.Fatalf("unexpected predictions %+v", predictions)
+		}
+	}
+	if _, err := nb.GetPredictions("sf-muni", "N", "5205"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("expected a single upstream call, got %v", n)
+	}
+}
+
+func TestPollPredictionsWaitsForTheLockOfThePredictions(t *testing.T) {
+	nb, calls := newPollingNextBus(t)
+	stop := PredictedStop{"N", "5205"}
+	lockId, err := nb.Lock(predictionsKey("sf-muni", stop))
+	if err != nil {
+		t.Fatal(err)
+	}
+	polled := make(chan error)
+	go func() {
+		_, err := nb.PollPredictions("sf-muni", stop, time.Minute)
+		polled <- err
+	}()
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(calls); n != 0 {
+		t.Errorf("the predictions shouldn't be fetched while somebody else holds their lock, got %v calls", n)
+	}
+	nb.Unlock(predictionsKey("sf-muni", stop), lockId)
+	if err = <-polled; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("expected the predictions to be fetched once the lock was released, got %v calls", n)
+	}
+}
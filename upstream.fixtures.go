@@ -0,0 +1,96 @@
+package main
+
+import "path/filepath"
+import "crypto/sha1"
+import "encoding/hex"
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "errors"
+import "bytes"
+import "log"
+import "os"
+
+// fixtureMaxName bounds the length of the fixture file names, below the 255 bytes most filesystems allow.
+const fixtureMaxName = 200
+
+// FixturesTransport intercepts the http requests made to the NextBus feed. In record mode
+// every response is written to the fixtures directory, in replay mode responses are read
+// from there and the network is never used. Fixtures are keyed by command and parameters,
+// i.e. <dir>/predictions/a=sf-muni&r=N&s=5205.xml
+// Recording failures are logged, the responses are still returned.
+type FixturesTransport struct {
+	mode string
+	dir  string
+	next http.RoundTripper
+}
+
+func NewFixturesTransport(mode, dir string, next http.RoundTripper) FixturesTransport {
+	return FixturesTransport{mode, dir, next}
+}
+
+func (transport FixturesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	query := req.URL.Query()
+	command := query.Get("command")
+	if command == "" {
+		return transport.next.RoundTrip(req)
+	}
+	path := fixturePath(transport.dir, command, query)
+	switch transport.mode {
+	case "replay":
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, errors.New("no fixture recorded for: " + req.URL.String())
+		} else if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    200,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"text/xml"}},
+			Body:          ioutil.NopCloser(bytes.NewReader(b)),
+			ContentLength: int64(len(b)),
+			Request:       req,
+		}, nil
+	case "record":
+		resp, err := transport.next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = ioutil.WriteFile(path, b, 0644)
+		}
+		if err != nil {
+			log.Printf("Recording fixture <%v> failed: %v", path, err.Error())
+		}
+		return resp, nil
+	}
+	return transport.next.RoundTrip(req)
+}
+
+// fixturePath returns the file of the fixture of a command. The t parameter of vehicleLocations changes
+// on every poll so it's left out, and the parameters too long for a file name are shortened with their hash.
+func fixturePath(dir, command string, query url.Values) string {
+	query.Del("command")
+	if command == "vehicleLocations" {
+		query.Del("t")
+	}
+	params := query.Encode()
+	if params == "" {
+		params = "_"
+	}
+	if len(params)+len(".xml") > fixtureMaxName {
+		sum := sha1.Sum([]byte(params))
+		params = params[:fixtureMaxName-len(".xml")-2*len(sum)-1] + "~" + hex.EncodeToString(sum[:])
+	}
+	return filepath.Join(dir, command, params+".xml")
+}
@@ -0,0 +1,70 @@
+package main
+
+import "path/filepath"
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "strings"
+import "testing"
+
+type stubTransport string
+
+func (body stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(string(body))), Request: req}, nil
+}
+
+func TestFixturePath(t *testing.T) {
+	query := url.Values{"command": {"predictions"}, "a": {"sf-muni"}, "r": {"N"}, "s": {"5205"}}
+	if path := fixturePath("dir", "predictions", query); path != filepath.Join("dir", "predictions", "a=sf-muni&r=N&s=5205.xml") {
+		t.Errorf("unexpected path %v", path)
+	}
+	first := fixturePath("dir", "vehicleLocations", url.Values{"a": {"sf-muni"}, "r": {"N"}, "t": {"1000"}})
+	second := fixturePath("dir", "vehicleLocations", url.Values{"a": {"sf-muni"}, "r": {"N"}, "t": {"2000"}})
+	if first != second || strings.Contains(first, "t=") {
+		t.Errorf("the t parameter of vehicleLocations should be left out, got %v and %v", first, second)
+	}
+	stops := url.Values{"a": {"sf-muni"}}
+	for i := 0; i < 50; i++ {
+		stops.Add("stops", "N|"+strings.Repeat("5", 4))
+	}
+	long := filepath.Base(fixturePath("dir", "predictionsForMultiStops", stops))
+	if len(long) > fixtureMaxName {
+		t.Errorf("expected a file name of %v bytes at most, got %v", fixtureMaxName, len(long))
+	}
+	stops.Set("a", "ttc")
+	if other := filepath.Base(fixturePath("dir", "predictionsForMultiStops", stops)); other == long {
+		t.Error("shortened file names should still tell the parameters apart")
+	}
+}
+
+func TestFixturesRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	req, _ := http.NewRequest("GET", "http://webservices.nextbus.com/service/publicXMLFeed?command=agencyList", nil)
+	if _, err := NewFixturesTransport("record", dir, stubTransport("<body/>")).RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := NewFixturesTransport("replay", dir, nil).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "<body/>" {
+		t.Errorf("expected the recorded response, got %s", b)
+	}
+	missing, _ := http.NewRequest("GET", "http://webservices.nextbus.com/service/publicXMLFeed?command=routeList&a=sf-muni", nil)
+	if _, err = NewFixturesTransport("replay", dir, nil).RoundTrip(missing); err == nil {
+		t.Error("expected an error for the responses not recorded")
+	}
+}
+
+func TestFixturesRecordFailuresStillRespond(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	ioutil.WriteFile(file, nil, 0644)
+	req, _ := http.NewRequest("GET", "http://webservices.nextbus.com/service/publicXMLFeed?command=agencyList", nil)
+	resp, err := NewFixturesTransport("record", file, stubTransport("<body/>")).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("recording failures shouldn't fail the request: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "<body/>" {
+		t.Errorf("expected the response, got %s", b)
+	}
+}
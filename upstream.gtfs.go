@@ -0,0 +1,379 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "archive/zip"
+import "encoding/csv"
+import "strconv"
+import "strings"
+import "errors"
+import "math"
+import "sort"
+import "fmt"
+import "io"
+
+type gtfsTrip struct {
+	id        string
+	routeId   string
+	serviceId string
+	direction string
+	headsign  string
+	blockId   string
+	stops     []gtfsStopTime
+}
+
+type gtfsStopTime struct {
+	stopId   string
+	sequence int
+	seconds  int
+}
+
+// LoadGTFSUpstream reads a GTFS static feed zip and converts it into the same structures that the NextBus
+// feed produces, so it can be served by a MemoryUpstream. Predictions are not part of a static feed.
+func LoadGTFSUpstream(path string) (MemoryUpstream, error) {
+	upstream := NewMemoryUpstream()
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return upstream, err
+	}
+	defer archive.Close()
+	files := map[string]*zip.File{}
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+	tables := map[string][]map[string]string{}
+	for _, name := range []string{"agency.txt", "routes.txt", "stops.txt", "trips.txt", "stop_times.txt", "calendar.txt"} {
+		file, ok := files[name]
+		if !ok {
+			return upstream, errors.New("missing file in gtfs feed: " + name)
+		}
+		if tables[name], err = readGTFSTable(file); err != nil {
+			return upstream, errors.New("unable to read " + name + ": " + err.Error())
+		}
+	}
+
+	defaultAgency := ""
+	for _, row := range tables["agency.txt"] {
+		agency := nextbus.Agency{Tag: gtfsAgencyTag(row), Title: row["agency_name"]}
+		upstream.Agencies = append(upstream.Agencies, agency)
+		if defaultAgency == "" {
+			defaultAgency = agency.Tag
+		}
+	}
+
+	serviceClasses := map[string]string{}
+	for _, row := range tables["calendar.txt"] {
+		serviceClasses[row["service_id"]] = gtfsServiceClass(row)
+	}
+
+	stops := map[string]nextbus.Stop{}
+	for _, row := range tables["stops.txt"] {
+		stops[row["stop_id"]] = nextbus.Stop{
+			Tag:    row["stop_id"],
+			Title:  row["stop_name"],
+			Lat:    row["stop_lat"],
+			Lon:    row["stop_lon"],
+			StopId: row["stop_code"],
+		}
+	}
+
+	trips := map[string]*gtfsTrip{}
+	for _, row := range tables["trips.txt"] {
+		trips[row["trip_id"]] = &gtfsTrip{
+			id:        row["trip_id"],
+			routeId:   row["route_id"],
+			serviceId: row["service_id"],
+			direction: row["direction_id"],
+			headsign:  row["trip_headsign"],
+			blockId:   row["block_id"],
+		}
+	}
+	for _, row := range tables["stop_times.txt"] {
+		trip, ok := trips[row["trip_id"]]
+		if !ok {
+			continue
+		}
+		sequence, err := strconv.Atoi(row["stop_sequence"])
+		if err != nil {
+			return upstream, err
+		}
+		departure := row["departure_time"]
+		if departure == "" {
+			departure = row["arrival_time"]
+		}
+		// untimed stops are interpolated by consumers, they are part of the directions but not of the schedules
+		seconds := -1
+		if departure != "" {
+			if seconds, err = parseGTFSTime(departure); err != nil {
+				return upstream, err
+			}
+		}
+		trip.stops = append(trip.stops, gtfsStopTime{row["stop_id"], sequence, seconds})
+	}
+	tripsByRoute := map[string][]*gtfsTrip{}
+	for _, trip := range trips {
+		sort.Sort(bySequence(trip.stops))
+		tripsByRoute[trip.routeId] = append(tripsByRoute[trip.routeId], trip)
+	}
+
+	for _, row := range tables["routes.txt"] {
+		agencyTag := defaultAgency
+		if row["agency_id"] != "" {
+			agencyTag = row["agency_id"]
+		}
+		route := nextbus.Route{Tag: row["route_id"], Title: gtfsRouteTitle(row)}
+		upstream.Routes[agencyTag] = append(upstream.Routes[agencyTag], route)
+		routeTrips := tripsByRoute[route.Tag]
+		sort.Sort(byFirstDeparture(routeTrips))
+		key := agencyTag + "/" + route.Tag
+		upstream.RouteConfigs[key] = gtfsRouteConfig(row, routeTrips, stops)
+		upstream.Schedules[key] = gtfsSchedules(route, routeTrips, serviceClasses, stops)
+	}
+	return upstream, nil
+}
+
+func readGTFSTable(file *zip.File) ([]map[string]string, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	records := csv.NewReader(reader)
+	records.FieldsPerRecord = -1
+	header, err := records.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	rows := []map[string]string{}
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		row := map[string]string{}
+		for i, column := range header {
+			if i < len(record) {
+				row[strings.TrimSpace(column)] = strings.TrimSpace(record[i])
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func parseGTFSTime(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, errors.New("malformed gtfs time: " + value)
+	}
+	seconds := 0
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+func gtfsAgencyTag(row map[string]string) string {
+	if row["agency_id"] != "" {
+		return row["agency_id"]
+	}
+	return strings.ToLower(strings.Join(strings.Fields(row["agency_name"]), "-"))
+}
+
+func gtfsRouteTitle(row map[string]string) string {
+	switch {
+	case row["route_short_name"] == "":
+		return row["route_long_name"]
+	case row["route_long_name"] == "":
+		return row["route_short_name"]
+	}
+	return row["route_short_name"] + "-" + row["route_long_name"]
+}
+
+// gtfsServiceClass translates the days of a calendar entry into the service classes used by NextBus,
+// calendars that don't match any of them keep their service id.
+func gtfsServiceClass(row map[string]string) string {
+	days := ""
+	for _, day := range []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"} {
+		days += row[day]
+	}
+	switch days {
+	case "1111100":
+		return "wkd"
+	case "0000010":
+		return "sat"
+	case "0000001":
+		return "sun"
+	case "0000011":
+		return "wkend"
+	case "1111111":
+		return "daily"
+	}
+	return row["service_id"]
+}
+
+// gtfsDirectionName follows the most common convention for direction_id, as the spec leaves it open.
+func gtfsDirectionName(direction string) string {
+	if direction == "1" {
+		return "Inbound"
+	}
+	return "Outbound"
+}
+
+func gtfsRouteConfig(row map[string]string, trips []*gtfsTrip, stops map[string]nextbus.Stop) nextbus.RouteConfig {
+	config := nextbus.RouteConfig{
+		Tag:           row["route_id"],
+		Title:         gtfsRouteTitle(row),
+		Color:         row["route_color"],
+		OppositeColor: row["route_text_color"],
+	}
+	// the longest trip of each direction is the one used to list the stops in order
+	longest := map[string]*gtfsTrip{}
+	directions := []string{}
+	for _, trip := range trips {
+		if existing, ok := longest[trip.direction]; !ok {
+			directions = append(directions, trip.direction)
+			longest[trip.direction] = trip
+		} else if len(trip.stops) > len(existing.stops) {
+			longest[trip.direction] = trip
+		}
+	}
+	sort.Strings(directions)
+	seen := map[string]bool{}
+	latMin, latMax, lonMin, lonMax := 90.0, -90.0, 180.0, -180.0
+	for _, direction := range directions {
+		trip := longest[direction]
+		routeDirection := nextbus.Direction{
+			Tag:      config.Tag + "_" + direction,
+			Title:    trip.headsign,
+			Name:     gtfsDirectionName(direction),
+			UseForUI: "true",
+		}
+		path := nextbus.Path{}
+		for _, stopTime := range trip.stops {
+			stop, ok := stops[stopTime.stopId]
+			if !ok {
+				continue
+			}
+			routeDirection.Stop = append(routeDirection.Stop, nextbus.DirectionStop{Tag: stop.Tag})
+			path.Point = append(path.Point, nextbus.Point{Lat: stop.Lat, Lon: stop.Lon})
+			if seen[stop.Tag] {
+				continue
+			}
+			seen[stop.Tag] = true
+			config.Stop = append(config.Stop, stop)
+			lat, latErr := strconv.ParseFloat(stop.Lat, 64)
+			lon, lonErr := strconv.ParseFloat(stop.Lon, 64)
+			if latErr == nil && lonErr == nil {
+				latMin, latMax = math.Min(latMin, lat), math.Max(latMax, lat)
+				lonMin, lonMax = math.Min(lonMin, lon), math.Max(lonMax, lon)
+			}
+		}
+		config.Direction = append(config.Direction, routeDirection)
+		config.Path = append(config.Path, path)
+	}
+	if len(config.Stop) > 0 {
+		config.LatMin, config.LatMax = fmt.Sprint(latMin), fmt.Sprint(latMax)
+		config.LonMin, config.LonMax = fmt.Sprint(lonMin), fmt.Sprint(lonMax)
+	}
+	return config
+}
+
+// gtfsSchedules builds one schedule matrix per service class and direction, like the NextBus schedules command.
+// Stops that a trip doesn't serve are marked with "--" just as NextBus does.
+func gtfsSchedules(route nextbus.Route, trips []*gtfsTrip, serviceClasses map[string]string, stops map[string]nextbus.Stop) []nextbus.Schedule {
+	schedules := []nextbus.Schedule{}
+	grouped := map[string][]*gtfsTrip{}
+	keys := []string{}
+	for _, trip := range trips {
+		serviceClass, ok := serviceClasses[trip.serviceId]
+		if !ok {
+			serviceClass = trip.serviceId
+		}
+		key := serviceClass + ":" + trip.direction
+		if _, ok := grouped[key]; !ok {
+			keys = append(keys, key)
+		}
+		grouped[key] = append(grouped[key], trip)
+	}
+	for _, key := range keys {
+		group := grouped[key]
+		schedule := nextbus.Schedule{
+			Tag:          route.Tag,
+			Title:        route.Title,
+			ServiceClass: key[:strings.LastIndex(key, ":")],
+			Direction:    gtfsDirectionName(group[0].direction),
+		}
+		// the longest trip gives the order of the columns, stops only served by other trips go at the end
+		longest := group[0]
+		for _, trip := range group {
+			if len(trip.stops) > len(longest.stops) {
+				longest = trip
+			}
+		}
+		for _, trip := range append([]*gtfsTrip{longest}, group...) {
+			for _, stopTime := range trip.stops {
+				if stopTime.seconds >= 0 && !gtfsHeaderHas(schedule.Header, stopTime.stopId) {
+					schedule.Header.Stop = append(schedule.Header.Stop, nextbus.HeaderStop{Tag: stopTime.stopId, Content: stops[stopTime.stopId].Title})
+				}
+			}
+		}
+		for _, trip := range group {
+			times := map[string]int{}
+			for _, stopTime := range trip.stops {
+				if _, ok := times[stopTime.stopId]; !ok && stopTime.seconds >= 0 {
+					times[stopTime.stopId] = stopTime.seconds
+				}
+			}
+			tr := nextbus.Tr{BlockID: trip.blockId}
+			for _, header := range schedule.Header.Stop {
+				seconds, ok := times[header.Tag]
+				if !ok {
+					tr.Stop = append(tr.Stop, nextbus.ScheduleStop{Tag: header.Tag, EpochTime: "-1", Content: "--"})
+					continue
+				}
+				tr.Stop = append(tr.Stop, nextbus.ScheduleStop{
+					Tag:       header.Tag,
+					EpochTime: strconv.Itoa(seconds * 1000),
+					Content:   fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60),
+				})
+			}
+			schedule.Tr = append(schedule.Tr, tr)
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules
+}
+
+func gtfsHeaderHas(header nextbus.Header, stopTag string) bool {
+	for _, stop := range header.Stop {
+		if stop.Tag == stopTag {
+			return true
+		}
+	}
+	return false
+}
+
+type bySequence []gtfsStopTime
+
+func (stops bySequence) Len() int           { return len(stops) }
+func (stops bySequence) Swap(i, j int)      { stops[i], stops[j] = stops[j], stops[i] }
+func (stops bySequence) Less(i, j int) bool { return stops[i].sequence < stops[j].sequence }
+
+type byFirstDeparture []*gtfsTrip
+
+func (trips byFirstDeparture) Len() int      { return len(trips) }
+func (trips byFirstDeparture) Swap(i, j int) { trips[i], trips[j] = trips[j], trips[i] }
+func (trips byFirstDeparture) Less(i, j int) bool {
+	if len(trips[i].stops) == 0 || len(trips[j].stops) == 0 {
+		return len(trips[i].stops) < len(trips[j].stops)
+	}
+	return trips[i].stops[0].seconds < trips[j].stops[0].seconds
+}
@@ -0,0 +1,119 @@
+package main
+
+import "path/filepath"
+import "archive/zip"
+import "testing"
+import "time"
+import "os"
+
+func writeGTFSFeed(t *testing.T, tables map[string]string) string {
+	path := filepath.Join(t.TempDir(), "feed.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	for name, content := range tables {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(content))
+	}
+	if err = archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var gtfsFeed = map[string]string{
+	"agency.txt": "\ufeffagency_name,agency_url,agency_timezone\nCity Transit,http://example.com,America/Los_Angeles\n",
+	"routes.txt": "route_id,route_short_name,route_long_name,route_color\n1,1,Main St,ff0000\n",
+	"stops.txt":  "stop_id,stop_name,stop_lat,stop_lon,stop_code\nA,First,37.1,-122.1,100\nB,Second,37.2,-122.2,200\nC,Third,37.3,-122.3,300\n",
+	"trips.txt":  "route_id,service_id,trip_id,trip_headsign,direction_id,block_id\n1,WK,t1,Downtown,1,b1\n1,WK,t2,Downtown,1,b2\n",
+	"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence\n" +
+		"t1,08:00:00,08:00:00,A,1\nt1,,,B,2\nt1,08:10:00,08:10:00,C,3\n" +
+		"t2,25:00:00,25:00:00,C,2\nt2,24:50:00,24:50:00,A,1\n",
+	"calendar.txt": "service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date\nWK,1,1,1,1,1,0,0,20260101,20261231\n",
+}
+
+func TestLoadGTFSUpstream(t *testing.T) {
+	upstream, err := LoadGTFSUpstream(writeGTFSFeed(t, gtfsFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upstream.Agencies) != 1 || upstream.Agencies[0].Tag != "city-transit" {
+		t.Fatalf("unexpected agencies %+v", upstream.Agencies)
+	}
+	routes := upstream.Routes["city-transit"]
+	if len(routes) != 1 || routes[0].Title != "1-Main St" {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+	config := upstream.RouteConfigs["city-transit/1"]
+	if len(config.Direction) != 1 || config.Direction[0].Name != "Inbound" || config.Direction[0].Title != "Downtown" {
+		t.Fatalf("unexpected directions %+v", config.Direction)
+	}
+	order := ""
+	for _, stop := range config.Direction[0].Stop {
+		order += stop.Tag
+	}
+	if order != "ABC" {
+		t.Errorf("stops should follow the sequence of the longest trip, got %v", order)
+	}
+	schedules := upstream.Schedules["city-transit/1"]
+	if len(schedules) != 1 || schedules[0].ServiceClass != "wkd" || len(schedules[0].Tr) != 2 {
+		t.Fatalf("unexpected schedules %+v", schedules)
+	}
+	// untimed stops are left out of the schedules
+	for _, header := range schedules[0].Header.Stop {
+		if header.Tag == "B" {
+			t.Error("untimed stops shouldn't be columns of the schedule")
+		}
+	}
+	late := schedules[0].Tr[1]
+	if late.BlockID != "b2" || late.Stop[0].EpochTime != "89400000" || late.Stop[1].Content != "25:00:00" {
+		t.Errorf("trips past midnight should keep epochs over 24 hours, got %+v", late)
+	}
+}
+
+func TestLoadGTFSUpstreamMissingFile(t *testing.T) {
+	feed := map[string]string{}
+	for name, content := range gtfsFeed {
+		if name != "calendar.txt" {
+			feed[name] = content
+		}
+	}
+	if _, err := LoadGTFSUpstream(writeGTFSFeed(t, feed)); err == nil {
+		t.Error("expected an error for a feed without calendar.txt")
+	}
+}
+
+func TestGTFSServiceClasses(t *testing.T) {
+	days := []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+	for mask, expected := range map[string]string{
+		"1111100": "wkd",
+		"0000010": "sat",
+		"0000001": "sun",
+		"0000011": "wkend",
+		"1111111": "daily",
+		"1010100": "MWF",
+	} {
+		row := map[string]string{"service_id": "MWF"}
+		for i, day := range days {
+			row[day] = mask[i : i+1]
+		}
+		serviceClass := gtfsServiceClass(row)
+		if serviceClass != expected {
+			t.Errorf("calendar %v: expected %v, got %v", mask, expected, serviceClass)
+			continue
+		}
+		// every weekday of the calendar is served by the known service classes
+		for i := range days {
+			weekday := time.Weekday((i + 1) % 7)
+			if expected != "MWF" && servesWeekday(serviceClass, weekday) != (mask[i] == '1') {
+				t.Errorf("calendar %v: service class %v serving %v should be %v", mask, serviceClass, weekday, mask[i] == '1')
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "encoding/json"
+import "os"
+
+// MemoryUpstream serves the transit data from memory, it allows to run the service without
+// network access. Maps are keyed by agency, agency/route and agency/route/stop tags.
+// Vehicles of a whole agency and messages are keyed by the agency tag alone.
+// Missing entries behave like the null responses of NextBus.
+type MemoryUpstream struct {
+	Agencies     []nextbus.Agency
+	Routes       map[string][]nextbus.Route
+	RouteConfigs map[string]nextbus.RouteConfig
+	Predictions  map[string]*StopPredictions
+	Schedules    map[string][]nextbus.Schedule
+	Vehicles     map[string]*VehicleLocations
+	Messages     map[string][]Message
+}
+
+func NewMemoryUpstream() MemoryUpstream {
+	return MemoryUpstream{
+		Agencies:     []nextbus.Agency{},
+		Routes:       map[string][]nextbus.Route{},
+		RouteConfigs: map[string]nextbus.RouteConfig{},
+		Predictions:  map[string]*StopPredictions{},
+		Schedules:    map[string][]nextbus.Schedule{},
+		Vehicles:     map[string]*VehicleLocations{},
+		Messages:     map[string][]Message{},
+	}
+}
+
+// LoadMemoryUpstream reads a MemoryUpstream from a JSON fixture file.
+func LoadMemoryUpstream(path string) (MemoryUpstream, error) {
+	upstream := NewMemoryUpstream()
+	file, err := os.Open(path)
+	if err != nil {
+		return upstream, err
+	}
+	defer file.Close()
+	err = json.NewDecoder(file).Decode(&upstream)
+	return upstream, err
+}
+
+func (upstream MemoryUpstream) GetAgencies() ([]nextbus.Agency, error) {
+	return upstream.Agencies, nil
+}
+
+func (upstream MemoryUpstream) GetRoutes(agencyTag string) ([]nextbus.Route, error) {
+	return upstream.Routes[agencyTag], nil
+}
+
+func (upstream MemoryUpstream) GetRouteConfig(agencyTag, routeTag string) (nextbus.RouteConfig, error) {
+	return upstream.RouteConfigs[agencyTag+"/"+routeTag], nil
+}
+
+func (upstream MemoryUpstream) GetPredictions(agencyTag, routeTag, stopTag string) (*StopPredictions, error) {
+	return upstream.Predictions[agencyTag+"/"+routeTag+"/"+stopTag], nil
+}
+
+func (upstream MemoryUpstream) GetMultiStopPredictions(agencyTag string, stops []PredictedStop) (map[PredictedStop]*StopPredictions, error) {
+	predictions := map[PredictedStop]*StopPredictions{}
+	for _, stop := range stops {
+		if value, ok := upstream.Predictions[agencyTag+"/"+stop.RouteTag+"/"+stop.StopTag]; ok {
+			predictions[stop] = value
+		}
+	}
+	return predictions, nil
+}
+
+func (upstream MemoryUpstream) GetSchedules(agencyTag, routeTag string) ([]nextbus.Schedule, error) {
+	return upstream.Schedules[agencyTag+"/"+routeTag], nil
+}
+
+func (upstream MemoryUpstream) GetVehicleLocations(agencyTag, routeTag string, since int64) (*VehicleLocations, error) {
+	if routeTag == "" {
+		return upstream.Vehicles[agencyTag], nil
+	}
+	return upstream.Vehicles[agencyTag+"/"+routeTag], nil
+}
+
+func (upstream MemoryUpstream) GetMessages(agencyTag string) ([]Message, error) {
+	return upstream.Messages[agencyTag], nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import "github.com/geraz69/nextbus"
+import "encoding/xml"
+import "net/http"
+import "net/url"
+import "strconv"
+import "strings"
+import "errors"
+
+// feedUrl is used for the commands that the nextbus package doesn't implement.
+const feedUrl = "http://webservices.nextbus.com/service/publicXMLFeed"
+
+// NextBusUpstream fetches the transit data from the public NextBus feed.
+type NextBusUpstream struct{}
+
+type feedError struct {
+	ShouldRetry string `xml:"shouldRetry,attr"`
+	Message     string `xml:",chardata"`
+}
+
+func (upstream NextBusUpstream) GetAgencies() ([]nextbus.Agency, error) {
+	return nextbus.GetAgencies()
+}
+
+func (upstream NextBusUpstream) GetRoutes(agencyTag string) ([]nextbus.Route, error) {
+	return nextbus.GetRoutes(agencyTag)
+}
+
+func (upstream NextBusUpstream) GetRouteConfig(agencyTag, routeTag string) (nextbus.RouteConfig, error) {
+	return nextbus.GetRouteConfig(agencyTag, routeTag, true, true)
+}
+
+// GetPredictions uses its own request instead of the nextbus package, which only keeps the first direction.
+func (upstream NextBusUpstream) GetPredictions(agencyTag, routeTag, stopTag string) (*StopPredictions, error) {
+	body := struct {
+		Error       *feedError       `xml:"Error"`
+		Predictions *StopPredictions `xml:"predictions"`
+	}{}
+	if err := fetchFeed("predictions", url.Values{"a": {agencyTag}, "r": {routeTag}, "s": {stopTag}}, &body); err != nil {
+		return nil, err
+	}
+	if body.Error != nil {
+		return nil, errors.New(body.Error.Message)
+	}
+	return body.Predictions, nil
+}
+
+func (upstream NextBusUpstream) GetMultiStopPredictions(agencyTag string, stops []PredictedStop) (map[PredictedStop]*StopPredictions, error) {
+	params := url.Values{"a": {agencyTag}}
+	for _, stop := range stops {
+		params.Add("stops", stop.RouteTag+"|"+stop.StopTag)
+	}
+	body := struct {
+		Error       *feedError        `xml:"Error"`
+		Predictions []StopPredictions `xml:"predictions"`
+	}{}
+	if err := fetchFeed("predictionsForMultiStops", params, &body); err != nil {
+		return nil, err
+	}
+	if body.Error != nil {
+		return nil, errors.New(body.Error.Message)
+	}
+	predictions := map[PredictedStop]*StopPredictions{}
+	for i := range body.Predictions {
+		predictions[PredictedStop{body.Predictions[i].RouteTag, body.Predictions[i].StopTag}] = &body.Predictions[i]
+	}
+	return predictions, nil
+}
+
+func (upstream NextBusUpstream) GetSchedules(agencyTag, routeTag string) ([]nextbus.Schedule, error) {
+	return nextbus.GetSchedules(agencyTag, routeTag)
+}
+
+func (upstream NextBusUpstream) GetVehicleLocations(agencyTag, routeTag string, since int64) (*VehicleLocations, error) {
+	params := url.Values{"a": {agencyTag}, "t": {strconv.FormatInt(since, 10)}}
+	if routeTag != "" {
+		params.Set("r", routeTag)
+	}
+	body := struct {
+		Error    *feedError `xml:"Error"`
+		Vehicle  []Vehicle  `xml:"vehicle"`
+		LastTime struct {
+			Time int64 `xml:"time,attr"`
+		} `xml:"lastTime"`
+	}{}
+	if err := fetchFeed("vehicleLocations", params, &body); err != nil {
+		return nil, err
+	}
+	if body.Error != nil {
+		return nil, errors.New(body.Error.Message)
+	}
+	if body.Vehicle == nil {
+		body.Vehicle = []Vehicle{}
+	}
+	return &VehicleLocations{body.Vehicle, body.LastTime.Time}, nil
+}
+
+func (upstream NextBusUpstream) GetMessages(agencyTag string) ([]Message, error) {
+	body := struct {
+		Error *feedError `xml:"Error"`
+		Route []struct {
+			Tag     string `xml:"tag,attr"`
+			Message []struct {
+				Id            string `xml:"id,attr"`
+				Priority      string `xml:"priority,attr"`
+				StartBoundary int64  `xml:"startBoundary,attr"`
+				EndBoundary   int64  `xml:"endBoundary,attr"`
+				Text          string `xml:"text"`
+				Configured    []struct {
+					Tag  string `xml:"tag,attr"`
+					Stop []struct {
+						Tag   string `xml:"tag,attr"`
+						Title string `xml:"title,attr"`
+					} `xml:"stop"`
+				} `xml:"routeConfiguredForMessage"`
+			} `xml:"message"`
+		} `xml:"route"`
+	}{}
+	if err := fetchFeed("messages", url.Values{"a": {agencyTag}}, &body); err != nil {
+		return nil, err
+	}
+	if body.Error != nil {
+		return nil, errors.New(body.Error.Message)
+	}
+	// the same message is repeated under every route it affects
+	messages := []Message{}
+	indexes := map[string]int{}
+	for _, route := range body.Route {
+		for _, m := range route.Message {
+			index, ok := indexes[m.Id]
+			if !ok {
+				index = len(messages)
+				indexes[m.Id] = index
+				messages = append(messages, Message{
+					Id:       m.Id,
+					Priority: m.Priority,
+					Text:     strings.TrimSpace(m.Text),
+					Routes:   []string{},
+					Stops:    []MessageStop{},
+					Start:    m.StartBoundary,
+					End:      m.EndBoundary,
+				})
+			}
+			message := &messages[index]
+			if route.Tag == "all" {
+				message.AllRoutes = true
+			} else if !contains(message.Routes, route.Tag) {
+				message.Routes = append(message.Routes, route.Tag)
+			}
+			// and so are the stops it's configured for
+			for _, configured := range m.Configured {
+				for _, stop := range configured.Stop {
+					if stop := (MessageStop{configured.Tag, stop.Tag, stop.Title}); !containsStop(message.Stops, stop) {
+						message.Stops = append(message.Stops, stop)
+					}
+				}
+			}
+		}
+	}
+	return messages, nil
+}
+
+func containsStop(stops []MessageStop, stop MessageStop) bool {
+	for _, s := range stops {
+		if s == stop {
+			return true
+		}
+	}
+	return false
+}
+
+func fetchFeed(command string, params url.Values, v interface{}) error {
+	params.Set("command", command)
+	resp, err := http.Get(feedUrl + "?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("NextBus responded with status: " + resp.Status)
+	}
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,79 @@
+package main
+
+import "log"
+
+type Vehicle struct {
+	Id              string  `xml:"id,attr"`
+	RouteTag        string  `xml:"routeTag,attr"`
+	DirTag          string  `xml:"dirTag,attr"`
+	Lat             float64 `xml:"lat,attr"`
+	Lon             float64 `xml:"lon,attr"`
+	Heading         int     `xml:"heading,attr"`
+	SpeedKmHr       float64 `xml:"speedKmHr,attr"`
+	SecsSinceReport int     `xml:"secsSinceReport,attr"`
+	Predictable     bool    `xml:"predictable,attr"`
+}
+
+// VehicleLocations is a snapshot of the vehicles, LastTime is the epoch in milliseconds of the
+// last update and it's the value to send as the t parameter to get the next updates only.
+type VehicleLocations struct {
+	Vehicle  []Vehicle
+	LastTime int64
+}
+
+// vehiclesMaxAge is the amount of seconds that NextBus keeps reporting a vehicle that
+// stopped sending its location.
+const vehiclesMaxAge = 15 * 60
+
+// GetVehicleLocations returns the vehicles of a route, or of the whole agency when the route tag is empty,
+// that reported their location after the since epoch in milliseconds (0 for all of them).
+func (nb NextBus) GetVehicleLocations(agencyTag, routeTag string, since int64) (*VehicleLocations, error) {
+	cacheValueKey := "agencies/" + agencyTag + "/vehicles"
+	if routeTag != "" {
+		cacheValueKey = "agencies/" + agencyTag + "/routes/" + routeTag + "/vehicles"
+	}
+	value := &VehicleLocations{}
+	err := nb.cachedFor(cacheValueKey, nb.ttlVehicles, &value, func() (interface{}, error) {
+		log.Printf("Fetching vehicle locations for agency/route: %v/%v", agencyTag, routeTag)
+		// the previous snapshot is updated with the vehicles that moved since then
+		previous := &VehicleLocations{}
+		found, _, err := nb.Get(cacheValueKey, &previous)
+		if err != nil || !found {
+			return nb.upstream.GetVehicleLocations(agencyTag, routeTag, 0)
+		}
+		updates, err := nb.upstream.GetVehicleLocations(agencyTag, routeTag, previous.LastTime)
+		if err != nil || updates == nil {
+			return updates, err
+		}
+		return mergeVehicleLocations(previous, updates), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if since <= 0 {
+		return value, nil
+	}
+	updated := &VehicleLocations{[]Vehicle{}, value.LastTime}
+	for _, vehicle := range value.Vehicle {
+		if value.LastTime-int64(vehicle.SecsSinceReport)*1000 > since {
+			updated.Vehicle = append(updated.Vehicle, vehicle)
+		}
+	}
+	return updated, nil
+}
+
+func mergeVehicleLocations(previous, updates *VehicleLocations) *VehicleLocations {
+	merged := &VehicleLocations{updates.Vehicle, updates.LastTime}
+	updated := map[string]bool{}
+	for _, vehicle := range updates.Vehicle {
+		updated[vehicle.Id] = true
+	}
+	elapsed := int((updates.LastTime - previous.LastTime) / 1000)
+	for _, vehicle := range previous.Vehicle {
+		vehicle.SecsSinceReport += elapsed
+		if !updated[vehicle.Id] && vehicle.SecsSinceReport < vehiclesMaxAge {
+			merged.Vehicle = append(merged.Vehicle, vehicle)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestMergeVehicleLocations(t *testing.T) {
+	previous := &VehicleLocations{[]Vehicle{
+		{Id: "1", Lat: 1, SecsSinceReport: 10},
+		{Id: "2", Lat: 2, SecsSinceReport: 20},
+		{Id: "3", Lat: 3, SecsSinceReport: vehiclesMaxAge - 30},
+	}, 1000000}
+	updates := &VehicleLocations{[]Vehicle{{Id: "1", Lat: 1.5, SecsSinceReport: 5}}, 1060000}
+	merged := mergeVehicleLocations(previous, updates)
+	if merged.LastTime != updates.LastTime {
+		t.Errorf("expected the last time of the updates, got %v", merged.LastTime)
+	}
+	vehicles := map[string]Vehicle{}
+	for _, vehicle := range merged.Vehicle {
+		vehicles[vehicle.Id] = vehicle
+	}
+	if len(vehicles) != 2 {
+		t.Fatalf("expected the updated vehicle and the one still reporting, got %+v", merged.Vehicle)
+	}
+	if vehicles["1"].Lat != 1.5 || vehicles["1"].SecsSinceReport != 5 {
+		t.Errorf("the updated vehicle should replace the previous one, got %+v", vehicles["1"])
+	}
+	if vehicles["2"].SecsSinceReport != 80 {
+		t.Errorf("the age of the vehicles that didn't move should grow by the elapsed time, got %+v", vehicles["2"])
+	}
+	if _, ok := vehicles["3"]; ok {
+		t.Error("vehicles older than vehiclesMaxAge should be dropped")
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "net/http"
+import "net/url"
+import "strconv"
+import "syscall"
+import "errors"
+import "bytes"
+import "time"
+import "net"
+import "log"
+
+const webhooksKey = "webhooks"
+
+// webhookAttempts is the number of times a notification is sent before giving up on it,
+// waiting twice as long after every failure starting from a second.
+const webhookAttempts = 4
+
+// webhookTokenLength is the least length of the tokens chosen by whoever creates the webhooks.
+const webhookTokenLength = 16
+
+// Webhook asks for a POST to Url when a vehicle of a route is Minutes or less away from a stop.
+// Webhooks expire after the configured ttl. The webhooks created with the same Token are listed together,
+// a token is made up when a webhook is created without one.
+type Webhook struct {
+	Id      string
+	Token   string
+	Agency  string
+	Route   string
+	Stop    string
+	Minutes int
+	Url     string
+	Created time.Time
+	Expires time.Time
+}
+
+// WebhookNotification is the payload sent to the webhooks, signed with the configured secret
+// in the X-Signature header as sha256=<hex hmac of the body>.
+type WebhookNotification struct {
+	WebhookId string
+	Agency    string
+	Route     string
+	Stop      string
+	StopTitle string
+	Direction string
+	Minutes   int
+	EpochTime int64
+	Vehicle   string
+	TripTag   string
+	Sent      time.Time
+}
+
+type Webhooks struct {
+	NextBus
+	secret   []byte
+	interval time.Duration
+	ttl      time.Duration
+	client   *http.Client
+	wait     time.Duration
+}
+
+func NewWebhooks(nextBus NextBus, secret string, interval, ttl time.Duration) Webhooks {
+	return Webhooks{nextBus, []byte(secret), interval, ttl, newWebhooksClient(), time.Second}
+}
+
+// newWebhooksClient has its own transport, so the notifications never go thru the one replaced
+// by the fixtures of the NextBus feed, nor thru proxies. It refuses to connect to any address that
+// isn't public once resolved, which covers the hosts that resolve differently after being created
+// and the redirects.
+func newWebhooksClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return errors.New("webhooks can't be sent to " + host)
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 2,
+	}
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}
+}
+
+// publicIP tells whether an address can be reached from the internet, which leaves out the loopback,
+// private, link-local and multicast ones the service could reach on its own network.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// publicHost tells whether every address of a host is public.
+func publicHost(host string) bool {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil || len(ips) == 0 {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetWebhooks returns the webhooks that haven't expired yet.
+func (webhooks Webhooks) GetWebhooks() ([]Webhook, error) {
+	stored := []Webhook{}
+	if _, _, err := webhooks.Get(webhooksKey, &stored); err != nil {
+		return nil, err
+	}
+	active := []Webhook{}
+	now := time.Now()
+	for _, webhook := range stored {
+		if now.Before(webhook.Expires) {
+			active = append(active, webhook)
+		}
+	}
+	return active, nil
+}
+
+// GetTokenWebhooks returns the active webhooks created with a token.
+func (webhooks Webhooks) GetTokenWebhooks(token string) ([]Webhook, error) {
+	if token == "" {
+		return nil, BadRequest("token is required")
+	}
+	active, err := webhooks.GetWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	listed := []Webhook{}
+	for _, webhook := range active {
+		if hmac.Equal([]byte(webhook.Token), []byte(token)) {
+			listed = append(listed, webhook)
+		}
+	}
+	return listed, nil
+}
+
+func (webhooks Webhooks) CreateWebhook(webhook Webhook) (*Webhook, error) {
+	if webhook.Agency == "" || webhook.Route == "" || webhook.Stop == "" {
+		return nil, BadRequest("Agency, Route and Stop are required")
+	}
+	if webhook.Minutes < 1 {
+		return nil, BadRequest("Minutes should be greater than zero")
+	}
+	target, err := url.Parse(webhook.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return nil, BadRequest("Url should be an absolute http or https url")
+	}
+	if !publicHost(target.Hostname()) {
+		return nil, BadRequest("Url should resolve to public addresses only")
+	}
+	if webhook.Token != "" && len(webhook.Token) < webhookTokenLength {
+		return nil, BadRequest("Token should be at least " + strconv.Itoa(webhookTokenLength) + " characters long")
+	}
+	if webhook.Id, err = randomHex(); err != nil {
+		return nil, err
+	}
+	if webhook.Token == "" {
+		if webhook.Token, err = randomHex(); err != nil {
+			return nil, err
+		}
+	}
+	webhook.Created = time.Now()
+	webhook.Expires = webhook.Created.Add(webhooks.ttl)
+	err = webhooks.update(func(stored []Webhook) []Webhook {
+		return append(stored, webhook)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// randomHex makes up the ids and tokens of the webhooks.
+func randomHex() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GetWebhook returns an active webhook, nil if there's none with the id.
+func (webhooks Webhooks) GetWebhook(id string) (*Webhook, error) {
+	active, err := webhooks.GetWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	for _, webhook := range active {
+		if webhook.Id == id {
+			return &webhook, nil
+		}
+	}
+	return nil, nil
+}
+
+// DeleteWebhook tells whether the webhook existed.
+func (webhooks Webhooks) DeleteWebhook(id string) (bool, error) {
+	deleted := false
+	err := webhooks.update(func(stored []Webhook) []Webhook {
+		kept := []Webhook{}
+		for _, webhook := range stored {
+			if webhook.Id == id {
+				deleted = true
+			} else {
+				kept = append(kept, webhook)
+			}
+		}
+		return kept
+	})
+	return deleted, err
+}
+
+// update changes the stored webhooks while holding their lock, leaving out the expired ones. The list
+// is kept as long as its newest webhook.
+func (webhooks Webhooks) update(change func([]Webhook) []Webhook) error {
+	lockId, err := webhooks.Lock(webhooksKey)
+	if err != nil {
+		return err
+	}
+	defer webhooks.Unlock(webhooksKey, lockId)
+	stored, err := webhooks.GetWebhooks()
+	if err != nil {
+		return err
+	}
+	return webhooks.SetFor(webhooksKey, change(stored), webhooks.ttl)
+}
+
+// Evaluate checks the predictions of the webhooks every interval until the program exits.
+func (webhooks Webhooks) Evaluate() {
+	for range time.Tick(webhooks.interval) {
+		if err := webhooks.evaluate(); err != nil {
+			log.Printf("Evaluating webhooks failed: %v", err.Error())
+		}
+	}
+}
+
+// evaluate notifies the webhooks which stops have a vehicle within their minutes. Only one instance
+// evaluates them per interval, and every arrival is notified once no matter how many times it's seen.
+func (webhooks Webhooks) evaluate() error {
+	if claimed, err := webhooks.claim(webhooksKey+"/evaluated", webhooks.interval); err != nil || !claimed {
+		return err
+	}
+	active, err := webhooks.GetWebhooks()
+	if err != nil {
+		return err
+	}
+	for _, webhook := range active {
+		predictions, err := webhooks.PollPredictions(webhook.Agency, PredictedStop{webhook.Route, webhook.Stop}, webhooks.interval)
+		if err != nil {
+			log.Printf("Predictions for webhook <%v> unavailable: %v", webhook.Id, err.Error())
+			continue
+		}
+		for _, direction := range predictions.Direction {
+			for _, prediction := range direction.Prediction {
+				// the minutes of the predictions are as old as the predictions
+				minutes := int(time.Unix(0, prediction.EpochTime*int64(time.Millisecond)).Sub(time.Now()).Minutes())
+				if minutes < 0 || minutes > webhook.Minutes {
+					continue
+				}
+				arrival := prediction.TripTag
+				if arrival == "" {
+					arrival = prediction.Vehicle + "/" + prediction.Block
+				}
+				firedKey := webhooksKey + "/" + webhook.Id + "/fired/" + arrival
+				fired := false
+				if found, _, err := webhooks.Get(firedKey, &fired); err != nil || found {
+					continue
+				}
+				// an arrival is remembered well after the vehicle is gone from the predictions
+				if err := webhooks.SetFor(firedKey, true, time.Duration(webhook.Minutes)*time.Minute+time.Hour); err != nil {
+					log.Print(err.Error())
+					continue
+				}
+				go webhooks.notify(webhook, WebhookNotification{webhook.Id, webhook.Agency, webhook.Route, webhook.Stop,
+					predictions.StopTitle, direction.Title, minutes, prediction.EpochTime,
+					prediction.Vehicle, prediction.TripTag, time.Now()})
+			}
+		}
+	}
+	return nil
+}
+
+func (webhooks Webhooks) notify(webhook Webhook, notification WebhookNotification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	mac := hmac.New(sha256.New, webhooks.secret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	wait := webhooks.wait
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = webhooks.post(webhook.Url, body, signature); err == nil {
+			return
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	log.Printf("Notifying webhook <%v> failed: %v", webhook.Id, err.Error())
+}
+
+func (webhooks Webhooks) post(target string, body []byte, signature string) error {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", signature)
+	resp, err := webhooks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("unexpected status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
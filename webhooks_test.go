@@ -0,0 +1,187 @@
+package main
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "io/ioutil"
+import "net/http/httptest"
+import "net/http"
+import "sync/atomic"
+import "testing"
+import "time"
+import "net"
+
+func newTestWebhooks() Webhooks {
+	return NewWebhooks(newTestNextBus(NewMemoryUpstream()), "secret", time.Minute, time.Hour)
+}
+
+func TestPublicIP(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1":    true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+		"224.0.0.1":       false,
+	} {
+		if publicIP(net.ParseIP(address)) != public {
+			t.Errorf("expected %v to be public %v", address, public)
+		}
+	}
+}
+
+func TestCreateWebhookRejectsInternalUrls(t *testing.T) {
+	webhooks := newTestWebhooks()
+	for _, target := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data", "https://10.0.0.1/hook", "ftp://93.184.216.34/hook"} {
+		webhook := Webhook{Agency: "sf-muni", Route: "N", Stop: "5205", Minutes: 5, Url: target}
+		if _, err := webhooks.CreateWebhook(webhook); err == nil {
+			t.Errorf("expected %v to be rejected", target)
+		} else if _, ok := err.(BadRequest); !ok {
+			t.Errorf("expected a bad request for %v, got %v", target, err)
+		}
+	}
+	webhook, err := webhooks.CreateWebhook(Webhook{Agency: "sf-muni", Route: "N", Stop: "5205", Minutes: 5, Url: "https://93.184.216.34/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := webhooks.GetWebhook(webhook.Id); found == nil || found.Url != webhook.Url {
+		t.Errorf("expected the created webhook, got %+v", found)
+	}
+	if found, _ := webhooks.GetWebhook("missing"); found != nil {
+		t.Errorf("expected no webhook, got %+v", found)
+	}
+}
+
+func TestWebhooksAreNotSentToInternalAddresses(t *testing.T) {
+	received := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(received, 1)
+	}))
+	defer server.Close()
+	if err := newTestWebhooks().post(server.URL, []byte("{}"), "sha256="); err == nil || atomic.LoadInt32(received) != 0 {
+		t.Error("notifications to loopback addresses should fail before connecting")
+	}
+}
+
+// newReceivingWebhooks sends the notifications to a test server thru its own client, as the loopback
+// addresses of the test servers are refused by the client of the webhooks.
+func newReceivingWebhooks(nextBus NextBus, server *httptest.Server) Webhooks {
+	webhooks := NewWebhooks(nextBus, "secret", 20*time.Millisecond, time.Hour)
+	webhooks.client = server.Client()
+	webhooks.wait = time.Millisecond
+	return webhooks
+}
+
+func TestWebhooksNotifyEveryArrivalOnce(t *testing.T) {
+	notifications := make(chan WebhookNotification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notification := WebhookNotification{}
+		json.NewDecoder(r.Body).Decode(&notification)
+		notifications <- notification
+	}))
+	defer server.Close()
+	memory := NewMemoryUpstream()
+	arrival := time.Now().Add(3*time.Minute).UnixNano() / int64(time.Millisecond)
+	memory.Predictions["sf-muni/N/5205"] = &StopPredictions{RouteTag: "N", StopTag: "5205", Direction: []PredictionsDirection{{
+		Title: "Inbound",
+		Prediction: []Prediction{
+			{EpochTime: arrival, TripTag: "t1", Vehicle: "v1"},
+			{EpochTime: arrival + 30*60*1000, TripTag: "t2", Vehicle: "v2"},
+		},
+	}}}
+	webhooks := newReceivingWebhooks(newTestNextBus(memory), server)
+	webhook := Webhook{Id: "w1", Agency: "sf-muni", Route: "N", Stop: "5205", Minutes: 5, Url: server.URL, Expires: time.Now().Add(time.Hour)}
+	if err := webhooks.update(func(stored []Webhook) []Webhook { return append(stored, webhook) }); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := webhooks.evaluate(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * webhooks.interval)
+	}
+	select {
+	case notification := <-notifications:
+		if notification.WebhookId != "w1" || notification.TripTag != "t1" || notification.Minutes < 2 || notification.Minutes > 3 {
+			t.Errorf("unexpected notification %+v", notification)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the arrival within the minutes to be notified")
+	}
+	select {
+	case notification := <-notifications:
+		t.Errorf("expected a single notification, got %+v", notification)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookNotificationsAreSigned(t *testing.T) {
+	signed := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		signed <- r.Header.Get("X-Signature") == "sha256="+hex.EncodeToString(mac.Sum(nil))
+	}))
+	defer server.Close()
+	webhooks := newReceivingWebhooks(newTestNextBus(NewMemoryUpstream()), server)
+	webhooks.notify(Webhook{Id: "w1", Url: server.URL}, WebhookNotification{WebhookId: "w1", Minutes: 3})
+	if !<-signed {
+		t.Error("expected the body to be signed with the secret")
+	}
+}
+
+func TestWebhookNotificationsAreRetried(t *testing.T) {
+	for _, c := range []struct {
+		failures int32
+		attempts int32
+	}{{2, 3}, {webhookAttempts, webhookAttempts}} {
+		attempts := new(int32)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(attempts, 1) <= c.failures {
+				w.WriteHeader(503)
+			}
+		}))
+		webhooks := newReceivingWebhooks(newTestNextBus(NewMemoryUpstream()), server)
+		webhooks.notify(Webhook{Id: "w1", Url: server.URL}, WebhookNotification{WebhookId: "w1"})
+		server.Close()
+		if n := atomic.LoadInt32(attempts); n != c.attempts {
+			t.Errorf("expected %v attempts after %v failures, got %v", c.attempts, c.failures, n)
+		}
+	}
+}
+
+func TestTokenWebhooks(t *testing.T) {
+	webhooks := newTestWebhooks()
+	created := []*Webhook{}
+	for _, token := range []string{"", "0123456789abcdef", "0123456789abcdef"} {
+		webhook, err := webhooks.CreateWebhook(Webhook{Token: token, Agency: "sf-muni", Route: "N", Stop: "5205", Minutes: 5, Url: "https://93.184.216.34/hook"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, webhook)
+	}
+	if created[0].Token == "" || created[0].Token == created[1].Token {
+		t.Errorf("expected a token to be made up, got %+v", created[0])
+	}
+	if listed, _ := webhooks.GetTokenWebhooks("0123456789abcdef"); len(listed) != 2 || listed[0].Id != created[1].Id || listed[1].Id != created[2].Id {
+		t.Errorf("expected the webhooks created with the token, got %+v", listed)
+	}
+	if listed, _ := webhooks.GetTokenWebhooks(created[0].Token); len(listed) != 1 || listed[0].Id != created[0].Id {
+		t.Errorf("expected the webhook with the made up token, got %+v", listed)
+	}
+	if _, err := webhooks.GetTokenWebhooks(""); err == nil {
+		t.Error("expected the token to be required")
+	}
+	if _, err := webhooks.CreateWebhook(Webhook{Token: "short", Agency: "sf-muni", Route: "N", Stop: "5205", Minutes: 5, Url: "https://93.184.216.34/hook"}); err == nil {
+		t.Error("expected short tokens to be rejected")
+	}
+}